@@ -0,0 +1,133 @@
+// Adaptive limiter for backends whose capacity is not known in advance. The caller reports whether the
+// requests it sent succeeded and how long they took, the limiter raises the refill rate additively while
+// the backend keeps up and cuts it multiplicatively when it does not (additive increase/multiplicative decrease,
+// like TCP congestion control). The rate is applied with SetRefillRate, so a single bucket or a whole
+// StepWell or StepWellPlus follows it.
+
+package aimd
+
+import (
+	"sync"
+	"time"
+)
+
+type Config struct {
+	MinRefillRate float64
+	// 0 means no upper bound
+	MaxRefillRate float64
+	// tokens per second added after every window without failures
+	AdditiveIncrease float64
+	// the rate is multiplied with it after a failure, between 0 and 1
+	MultiplicativeDecrease float64
+	// successful requests slower than LatencyThreshold count as failures, 0 only looks at failures
+	LatencyThreshold time.Duration
+	// the rate changes at most once per window. The failures of one overload arrive close together,
+	// without the window every one of them would cut the rate again.
+	Window time.Duration
+}
+
+// Target is anything with a refill rate, which includes all buckets, StepWell and StepWellPlus
+type Target interface {
+	SetRefillRate(refillRate float64)
+}
+
+type Limiter struct {
+	config     Config
+	targets    []Target
+	refillRate float64
+	// Unix timestamps in nanoseconds of the last changes
+	lastIncrease int64
+	lastDecrease int64
+	sync.Mutex
+}
+
+func NewLimiter(config Config, refillRate float64, now time.Time, targets ...Target) *Limiter {
+	if config.MultiplicativeDecrease <= 0 || config.MultiplicativeDecrease >= 1 {
+		config.MultiplicativeDecrease = 0.5
+	}
+	if config.Window <= 0 {
+		config.Window = time.Second
+	}
+	limiter := &Limiter{
+		config:       config,
+		targets:      targets,
+		refillRate:   refillRate,
+		lastIncrease: now.UnixNano(),
+		lastDecrease: now.UnixNano() - int64(config.Window),
+	}
+	limiter.setRefillRate(limiter.clamp(refillRate))
+	return limiter
+}
+
+func (limiter *Limiter) clamp(refillRate float64) float64 {
+	if refillRate < limiter.config.MinRefillRate {
+		refillRate = limiter.config.MinRefillRate
+	}
+	if limiter.config.MaxRefillRate > 0 && refillRate > limiter.config.MaxRefillRate {
+		refillRate = limiter.config.MaxRefillRate
+	}
+	return refillRate
+}
+
+// setRefillRate applies the rate to all targets, the caller holds the lock
+func (limiter *Limiter) setRefillRate(refillRate float64) {
+	limiter.refillRate = refillRate
+	for _, target := range limiter.targets {
+		target.SetRefillRate(refillRate)
+	}
+}
+
+// Report feeds the outcome of one request to the limiter
+func (limiter *Limiter) Report(success bool, latency time.Duration, now time.Time) {
+	if success && limiter.config.LatencyThreshold > 0 && latency > limiter.config.LatencyThreshold {
+		success = false
+	}
+	if success {
+		limiter.increase(now)
+	} else {
+		limiter.decrease(now)
+	}
+}
+
+func (limiter *Limiter) ReportSuccess(latency time.Duration, now time.Time) {
+	limiter.Report(true, latency, now)
+}
+
+func (limiter *Limiter) ReportFailure(now time.Time) {
+	limiter.Report(false, 0, now)
+}
+
+// increase raises the rate once a full window passed since the last change
+func (limiter *Limiter) increase(now time.Time) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	nowUnix := now.UnixNano()
+	window := int64(limiter.config.Window)
+	if nowUnix-limiter.lastIncrease < window || nowUnix-limiter.lastDecrease < window {
+		return
+	}
+	limiter.lastIncrease = nowUnix
+	if refillRate := limiter.clamp(limiter.refillRate + limiter.config.AdditiveIncrease); refillRate != limiter.refillRate {
+		limiter.setRefillRate(refillRate)
+	}
+}
+
+func (limiter *Limiter) decrease(now time.Time) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	nowUnix := now.UnixNano()
+	if nowUnix-limiter.lastDecrease < int64(limiter.config.Window) {
+		return
+	}
+	limiter.lastDecrease = nowUnix
+	limiter.lastIncrease = nowUnix
+	if refillRate := limiter.clamp(limiter.refillRate * limiter.config.MultiplicativeDecrease); refillRate != limiter.refillRate {
+		limiter.setRefillRate(refillRate)
+	}
+}
+
+func (limiter *Limiter) GetRefillRate() float64 {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.refillRate
+}
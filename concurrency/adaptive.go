@@ -0,0 +1,325 @@
+// Adaptive concurrency limits which find the limit of a backend from the round trip times of its requests,
+// following the algorithms of Netflix's concurrency-limits. Once the backend queues requests their RTT grows
+// beyond the RTT without load, the limit shrinks until the queue is gone and grows again while the RTT stays low.
+
+package concurrency
+
+import (
+	"errors"
+	"math"
+	"stepwell/stepwell"
+	"sync"
+	"time"
+)
+
+// Sample is one finished request together with the current estimates
+type Sample struct {
+	Limit float64
+	RTT   time.Duration
+	// smallest RTT seen recently, the estimate of the RTT without queueing
+	MinRTT time.Duration
+	// exponential moving average of the RTT
+	SmoothedRTT time.Duration
+	// requests in flight when the request finished, including itself
+	InFlight int64
+	// the request failed or timed out because of overload
+	Dropped bool
+}
+
+// Algorithm computes the next limit from one sample
+type Algorithm interface {
+	Update(sample Sample) float64
+}
+
+// appLimited is true when the caller does not use the limit, its RTT says nothing about a larger limit
+func appLimited(sample Sample) bool {
+	return float64(sample.InFlight)*2 < sample.Limit
+}
+
+// Vegas estimates the queue at the backend as limit * (1 - minRTT/RTT) and keeps it between alpha and beta,
+// which grow with log10 of the limit like in TCP Vegas
+type Vegas struct {
+	Alpha float64
+	Beta  float64
+	// weight of the new limit, between 0 and 1
+	Smoothing float64
+}
+
+func NewVegas() *Vegas {
+	return &Vegas{Alpha: 3, Beta: 6, Smoothing: 1}
+}
+
+func (vegas *Vegas) Update(sample Sample) float64 {
+	limit := sample.Limit
+	logLimit := math.Max(1, math.Log10(limit))
+	var newLimit float64
+	switch {
+	case sample.Dropped:
+		newLimit = limit - logLimit
+	case appLimited(sample) || sample.RTT <= 0:
+		return limit
+	default:
+		queue := math.Ceil(limit * (1 - float64(sample.MinRTT)/float64(sample.RTT)))
+		switch {
+		case queue <= logLimit:
+			newLimit = limit + vegas.Beta*logLimit
+		case queue < vegas.Alpha*logLimit:
+			newLimit = limit + logLimit
+		case queue > vegas.Beta*logLimit:
+			newLimit = limit - logLimit
+		default:
+			return limit
+		}
+	}
+	return limit*(1-vegas.Smoothing) + newLimit*vegas.Smoothing
+}
+
+// Gradient scales the limit with the ratio of the minimum RTT to the current RTT and adds sqrt(limit)
+// as headroom for the queue. Compared to Vegas the limit moves in proportion to the queue instead of in steps.
+type Gradient struct {
+	// RTT may grow to Tolerance times the minimum RTT before the limit goes down
+	Tolerance float64
+	Smoothing float64
+}
+
+func NewGradient() *Gradient {
+	return &Gradient{Tolerance: 1.5, Smoothing: 0.2}
+}
+
+func (gradient *Gradient) Update(sample Sample) float64 {
+	limit := sample.Limit
+	if appLimited(sample) || sample.RTT <= 0 {
+		return limit
+	}
+	ratio := gradient.Tolerance * float64(sample.MinRTT) / float64(sample.RTT)
+	if sample.Dropped {
+		ratio = 0.5
+	}
+	ratio = math.Max(0.5, math.Min(1, ratio))
+	newLimit := limit*ratio + math.Sqrt(limit)
+	return limit*(1-gradient.Smoothing) + newLimit*gradient.Smoothing
+}
+
+// AIMD adds one to the limit after every sample which used the limit and backs off on drops or slow requests
+type AIMD struct {
+	Backoff float64
+	// requests slower than Timeout count as dropped, 0 only looks at drops
+	Timeout time.Duration
+}
+
+func NewAIMD() *AIMD {
+	return &AIMD{Backoff: 0.9}
+}
+
+func (aimd *AIMD) Update(sample Sample) float64 {
+	if sample.Dropped || (aimd.Timeout > 0 && sample.RTT > aimd.Timeout) {
+		return sample.Limit * aimd.Backoff
+	}
+	if appLimited(sample) {
+		return sample.Limit
+	}
+	return sample.Limit + 1
+}
+
+// Adaptive is a Tree whose global limit follows an Algorithm. The per-core limits stay as the tree was built.
+type Adaptive struct {
+	tree      *Tree
+	algorithm Algorithm
+	minLimit  float64
+	maxLimit  float64
+	limit     float64
+	// the minimum RTT is forgotten after minRTTWindow, so it follows a backend which became slower for good
+	minRTT       time.Duration
+	minRTTWindow time.Duration
+	minRTTUntil  time.Time
+	smoothedRTT  time.Duration
+	rttSmoothing float64
+	sync.Mutex
+}
+
+func NewAdaptive(tree *Tree, algorithm Algorithm, initialLimit int64, minLimit int64, maxLimit int64) *Adaptive {
+	if minLimit < 1 {
+		minLimit = 1
+	}
+	adaptive := &Adaptive{
+		tree:         tree,
+		algorithm:    algorithm,
+		minLimit:     float64(minLimit),
+		maxLimit:     float64(maxLimit),
+		minRTTWindow: time.Minute,
+		rttSmoothing: 0.05,
+	}
+	adaptive.setLimit(float64(initialLimit))
+	return adaptive
+}
+
+// setLimit clamps the limit and applies it to the tree, the caller holds the lock
+func (adaptive *Adaptive) setLimit(limit float64) {
+	limit = math.Max(adaptive.minLimit, limit)
+	if adaptive.maxLimit > 0 {
+		limit = math.Min(adaptive.maxLimit, limit)
+	}
+	adaptive.limit = limit
+	adaptive.tree.SetLimit(int64(limit))
+}
+
+func (adaptive *Adaptive) Acquire(port uint64) bool {
+	return adaptive.tree.Acquire(port, 1)
+}
+
+// Release gives the permit back and feeds the RTT of the request to the algorithm
+func (adaptive *Adaptive) Release(port uint64, rtt time.Duration, dropped bool, now time.Time) {
+	inFlight := adaptive.tree.GetInFlight()
+	adaptive.tree.Release(port, 1)
+
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	if rtt > 0 {
+		if adaptive.minRTT == 0 || rtt < adaptive.minRTT || now.After(adaptive.minRTTUntil) {
+			adaptive.minRTT = rtt
+			adaptive.minRTTUntil = now.Add(adaptive.minRTTWindow)
+		}
+		if adaptive.smoothedRTT == 0 {
+			adaptive.smoothedRTT = rtt
+		} else {
+			adaptive.smoothedRTT = time.Duration((1-adaptive.rttSmoothing)*float64(adaptive.smoothedRTT) + adaptive.rttSmoothing*float64(rtt))
+		}
+	}
+	adaptive.setLimit(adaptive.algorithm.Update(Sample{
+		Limit:       adaptive.limit,
+		RTT:         rtt,
+		MinRTT:      adaptive.minRTT,
+		SmoothedRTT: adaptive.smoothedRTT,
+		InFlight:    inFlight,
+		Dropped:     dropped,
+	}))
+}
+
+// Cancel gives the permit back without a sample, for requests which were never sent
+func (adaptive *Adaptive) Cancel(port uint64) {
+	adaptive.tree.Release(port, 1)
+}
+
+func (adaptive *Adaptive) GetLimit() int64 {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	return int64(adaptive.limit)
+}
+
+func (adaptive *Adaptive) GetMinRTT() time.Duration {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	return adaptive.minRTT
+}
+
+func (adaptive *Adaptive) GetSmoothedRTT() time.Duration {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	return adaptive.smoothedRTT
+}
+
+func (adaptive *Adaptive) GetInFlight() int64 {
+	return adaptive.tree.GetInFlight()
+}
+
+// Config sets up the rate limit and the concurrency limit of a Limiter in one place
+type Config struct {
+	NumCores uint64 `json:"numCores"`
+	// the rate limit is a StepWell, a RefillRate of 0 disables it
+	BucketType int     `json:"bucketType"`
+	Capacity   int64   `json:"capacity"`
+	RefillRate float64 `json:"refillRate"`
+	// "vegas", "gradient", "aimd" or "fixed"
+	Algorithm    string `json:"algorithm"`
+	InitialLimit int64  `json:"initialLimit"`
+	MinLimit     int64  `json:"minLimit"`
+	MaxLimit     int64  `json:"maxLimit"`
+	// permits of every core, 0 lets a single core use the whole limit
+	CoreLimit int64 `json:"coreLimit"`
+}
+
+// Limiter admits a request if it gets tokens from the rate limit and a permit from the adaptive concurrency limit
+type Limiter struct {
+	rate     *stepwell.StepWell
+	inFlight *Adaptive
+}
+
+func NewAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case "vegas":
+		return NewVegas(), nil
+	case "gradient":
+		return NewGradient(), nil
+	case "aimd":
+		return NewAIMD(), nil
+	case "", "fixed":
+		return nil, nil
+	default:
+		return nil, errors.New("unknown concurrency limit algorithm " + name)
+	}
+}
+
+func NewLimiter(config Config, now time.Time) (*Limiter, error) {
+	if config.NumCores <= 0 {
+		config.NumCores = 1
+	}
+	algorithm, err := NewAlgorithm(config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if config.InitialLimit <= 0 {
+		return nil, errors.New("initialLimit has to be positive")
+	}
+
+	maxLimit := config.MaxLimit
+	if algorithm == nil {
+		// a fixed limit never moves
+		config.MinLimit = config.InitialLimit
+		maxLimit = config.InitialLimit
+		algorithm = fixed{}
+	}
+	coreLimit := config.CoreLimit
+	if coreLimit <= 0 {
+		coreLimit = math.MaxInt64
+	}
+
+	limiter := &Limiter{
+		inFlight: NewAdaptive(NewTree(config.NumCores, coreLimit, config.InitialLimit), algorithm, config.InitialLimit, config.MinLimit, maxLimit),
+	}
+	if config.RefillRate > 0 {
+		limiter.rate = stepwell.NewStepwell(config.NumCores, now, config.BucketType, config.Capacity, config.RefillRate)
+	}
+	return limiter, nil
+}
+
+type fixed struct{}
+
+func (fixed) Update(sample Sample) float64 {
+	return sample.Limit
+}
+
+// Acquire takes the permit first, a request which has no permit does not use up tokens
+func (limiter *Limiter) Acquire(port uint64, amount int64, now time.Time) bool {
+	if !limiter.inFlight.Acquire(port) {
+		return false
+	}
+	if limiter.rate != nil && !limiter.rate.IsAllowed(port, amount, now) {
+		limiter.inFlight.Cancel(port)
+		return false
+	}
+	return true
+}
+
+// Release ends a request which was admitted by Acquire on the same port
+func (limiter *Limiter) Release(port uint64, rtt time.Duration, dropped bool, now time.Time) {
+	limiter.inFlight.Release(port, rtt, dropped, now)
+}
+
+// GetRate returns the StepWell of the rate limit, nil if there is none
+func (limiter *Limiter) GetRate() *stepwell.StepWell {
+	return limiter.rate
+}
+
+func (limiter *Limiter) GetAdaptive() *Adaptive {
+	return limiter.inFlight
+}
@@ -0,0 +1,218 @@
+// Concurrency limiters which cap the requests in flight instead of the requests per second. A rate limit
+// lets slow requests pile up, a concurrency limit does not: a permit is only given back once the request is done.
+//
+// Semaphore is the permit counterpart of a token bucket, it never refills and only gets its permits back
+// with Release. Tree arranges semaphores like the buckets of a StepWell, every core has its own permits
+// and the root is the ceiling for all of them.
+
+package concurrency
+
+import (
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"sync/atomic"
+	"time"
+)
+
+type Semaphore struct {
+	limit    int64
+	inFlight int64
+}
+
+func NewSemaphore(limit int64) *Semaphore {
+	return &Semaphore{limit: limit}
+}
+
+// Acquire takes amount permits if they are free, it never blocks
+func (semaphore *Semaphore) Acquire(amount int64) bool {
+	for {
+		inFlight := atomic.LoadInt64(&semaphore.inFlight)
+		if inFlight+amount > atomic.LoadInt64(&semaphore.limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&semaphore.inFlight, inFlight, inFlight+amount) {
+			return true
+		}
+	}
+}
+
+func (semaphore *Semaphore) Release(amount int64) {
+	atomic.AddInt64(&semaphore.inFlight, -amount)
+}
+
+// SetLimit changes the limit right away, permits above a lowered limit stay in use until they are released
+func (semaphore *Semaphore) SetLimit(limit int64) {
+	atomic.StoreInt64(&semaphore.limit, limit)
+}
+
+func (semaphore *Semaphore) GetLimit() int64 {
+	return atomic.LoadInt64(&semaphore.limit)
+}
+
+func (semaphore *Semaphore) GetInFlight() int64 {
+	return atomic.LoadInt64(&semaphore.inFlight)
+}
+
+// The semaphore is a bucket without refill, so it fits into the nodes of a StepWell tree
+
+func (semaphore *Semaphore) IsAllowed(amount int64, now time.Time) bool {
+	return semaphore.Acquire(amount)
+}
+
+func (semaphore *Semaphore) AllowUpTo(max int64, now time.Time) int64 {
+	for {
+		inFlight := atomic.LoadInt64(&semaphore.inFlight)
+		granted := atomic.LoadInt64(&semaphore.limit) - inFlight
+		if granted > max {
+			granted = max
+		}
+		if granted <= 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&semaphore.inFlight, inFlight, inFlight+granted) {
+			return granted
+		}
+	}
+}
+
+func (semaphore *Semaphore) ReturnTokens(amount int64) {
+	semaphore.Release(amount)
+}
+
+func (semaphore *Semaphore) GetCapacity() int64 {
+	return semaphore.GetLimit()
+}
+
+func (semaphore *Semaphore) GetTokens() int64 {
+	free := semaphore.GetLimit() - semaphore.GetInFlight()
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+// permits do not refill over time
+func (semaphore *Semaphore) SetRefillRate(refillRate float64) {
+}
+
+func (semaphore *Semaphore) SetCapacity(capacity int64) {
+	semaphore.SetLimit(capacity)
+}
+
+// Tree is a StepWell of semaphores. The leaves hold the permits of one core each, all nodes above them
+// hold the global limit, so a request needs a permit of its core and of every node up to the root.
+// Unlike StepWell a refused request gives back the permits it already took, otherwise they would be lost for good.
+type Tree struct {
+	stepwell *stepwell.StepWell
+	// the nodes in the order NewStepwellWithBuckets created them, the root first and the leaves last
+	nodes    []*Semaphore
+	numCores uint64
+}
+
+func NewTree(numCores uint64, perCoreLimit int64, globalLimit int64) *Tree {
+	firstLeaf := int(stepwell.NumNodes(numCores) - numCores)
+	var nodes []*Semaphore
+	tree := stepwell.NewStepwellWithBuckets(numCores, globalLimit, 0, func(index int) tokenbucket.TokenBucketInterface {
+		limit := perCoreLimit
+		// with a single core the root is the leaf as well and takes the smaller limit
+		if index < firstLeaf || (index == 0 && globalLimit < perCoreLimit) {
+			limit = globalLimit
+		}
+		nodes = append(nodes, NewSemaphore(limit))
+		return nodes[index]
+	})
+	if tree == nil {
+		return nil
+	}
+	return &Tree{stepwell: tree, nodes: nodes, numCores: numCores}
+}
+
+func (tree *Tree) Acquire(port uint64, amount int64) bool {
+	leaf := tree.stepwell.Cores[port]
+	for curr := leaf; curr != nil; curr = curr.Parent {
+		if !curr.TokenBucket.IsAllowed(amount, time.Time{}) {
+			for taken := leaf; taken != curr; taken = taken.Parent {
+				taken.TokenBucket.ReturnTokens(amount)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Release has to use the port of the Acquire
+func (tree *Tree) Release(port uint64, amount int64) {
+	for curr := tree.stepwell.Cores[port]; curr != nil; curr = curr.Parent {
+		curr.TokenBucket.ReturnTokens(amount)
+	}
+}
+
+// SetLimit changes the global limit of the root and the nodes between it and the leaves
+func (tree *Tree) SetLimit(limit int64) {
+	firstLeaf := len(tree.nodes) - int(tree.numCores)
+	for _, node := range tree.nodes[:firstLeaf] {
+		node.SetLimit(limit)
+	}
+	if firstLeaf == 0 {
+		tree.nodes[0].SetLimit(limit)
+	}
+}
+
+// SetCoreLimit changes the limit of every leaf
+func (tree *Tree) SetCoreLimit(limit int64) {
+	for _, node := range tree.nodes[len(tree.nodes)-int(tree.numCores):] {
+		node.SetLimit(limit)
+	}
+}
+
+func (tree *Tree) GetLimit() int64 {
+	return tree.nodes[0].GetLimit()
+}
+
+// GetInFlight returns the permits in use on all cores
+func (tree *Tree) GetInFlight() int64 {
+	return tree.nodes[0].GetInFlight()
+}
+
+func (tree *Tree) GetNumCores() uint64 {
+	return tree.numCores
+}
+
+// Combined admits a request only if the rate limiter has tokens for it and a permit is free. The tokens
+// are spent for good, the permit has to be released when the request is done.
+type Combined struct {
+	rate     stepwell.StepWellInterface
+	inFlight *Tree
+}
+
+// rate and inFlight must have the same number of ports
+func NewCombined(rate stepwell.StepWellInterface, inFlight *Tree) *Combined {
+	return &Combined{rate: rate, inFlight: inFlight}
+}
+
+// Acquire takes the permit first, a request which has no permit does not use up tokens
+func (combined *Combined) Acquire(port uint64, amount int64, now time.Time) bool {
+	if !combined.inFlight.Acquire(port, 1) {
+		return false
+	}
+	if !combined.rate.IsAllowed(port, amount, now) {
+		combined.inFlight.Release(port, 1)
+		return false
+	}
+	return true
+}
+
+func (combined *Combined) Release(port uint64) {
+	combined.inFlight.Release(port, 1)
+}
+
+func (combined *Combined) GetTokens(port uint64) int64 {
+	return combined.rate.GetTokens(port)
+}
+
+func (combined *Combined) GetInFlight() int64 {
+	return combined.inFlight.GetInFlight()
+}
+
+var _ tokenbucket.TokenBucketInterface = (*Semaphore)(nil)
+var _ tokenbucket.CapacitySetter = (*Semaphore)(nil)
@@ -0,0 +1,237 @@
+// StepWell whose root lives on another host: the local tree leases tokens from a root service over TCP,
+// which gives one cap for the whole cluster while most requests are still decided locally.
+//
+// Lease request (8 bytes, big endian): wanted tokens int64
+// Lease response (8 bytes, big endian): granted tokens int64
+
+package distributed
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const frameSize = 8
+
+// RootServer hands out leases from the cluster-wide bucket
+type RootServer struct {
+	bucket tokenbucket.TokenBucketInterface
+}
+
+// bucketType has to be thread safe, the connections of all hosts are served concurrently
+func NewRootServer(bucketType int, capacity int64, refillRate float64, now time.Time) *RootServer {
+	return &RootServer{bucket: tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now)}
+}
+
+func (root *RootServer) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return root.Serve(listener)
+}
+
+func (root *RootServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go root.handleConn(conn)
+	}
+}
+
+func (root *RootServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	var frame [frameSize]byte
+	for {
+		if _, err := io.ReadFull(conn, frame[:]); err != nil {
+			return
+		}
+		wanted := int64(binary.BigEndian.Uint64(frame[:]))
+		granted := int64(0)
+		if wanted > 0 {
+			granted = root.bucket.AllowUpTo(wanted, time.Now())
+		}
+		binary.BigEndian.PutUint64(frame[:], uint64(granted))
+		if _, err := conn.Write(frame[:]); err != nil {
+			return
+		}
+	}
+}
+
+type Policy int
+
+const (
+	// FailClosed denies every request which needs the root while it is unreachable
+	FailClosed Policy = iota
+	// FailOpen allows them, only the local buckets limit the host then
+	FailOpen
+)
+
+var errUnreachable = errors.New("root is unreachable")
+
+// RemoteBucket is the local stand-in of the root bucket. It serves requests from the tokens it leased
+// and only talks to the root when they run out.
+type RemoteBucket struct {
+	addr string
+	// how many tokens are leased on top of the request which ran out
+	leaseSize int64
+	timeout   time.Duration
+	policy    Policy
+	// after a failed lease the root is not asked again for retryDelay
+	retryDelay time.Duration
+	leased     int64
+	// Store as Unix timestamp to be able to use atomic operations
+	failedUntil int64
+	conn        net.Conn
+	sync.Mutex
+}
+
+func NewRemoteBucket(addr string, leaseSize int64, timeout time.Duration, policy Policy) *RemoteBucket {
+	return &RemoteBucket{
+		addr:       addr,
+		leaseSize:  leaseSize,
+		timeout:    timeout,
+		policy:     policy,
+		retryDelay: timeout,
+	}
+}
+
+// lease asks the root for more tokens and takes between min and max of them for the caller. Only one
+// goroutine talks to the root at a time, the ones queued behind it first look at what it leased.
+func (bucket *RemoteBucket) lease(min int64, max int64, now time.Time) (int64, error) {
+	bucket.Lock()
+	defer bucket.Unlock()
+
+	if granted := bucket.take(min, max); granted > 0 {
+		return granted, nil
+	}
+	if now.UnixNano() < atomic.LoadInt64(&bucket.failedUntil) {
+		return 0, errUnreachable
+	}
+
+	if bucket.conn == nil {
+		conn, err := net.DialTimeout("tcp", bucket.addr, bucket.timeout)
+		if err != nil {
+			atomic.StoreInt64(&bucket.failedUntil, now.Add(bucket.retryDelay).UnixNano())
+			return 0, err
+		}
+		bucket.conn = conn
+	}
+
+	var frame [frameSize]byte
+	binary.BigEndian.PutUint64(frame[:], uint64(max+bucket.leaseSize))
+	// now is the clock of the caller, which may be synthetic, the socket only knows the wall clock
+	bucket.conn.SetDeadline(time.Now().Add(bucket.timeout))
+	_, err := bucket.conn.Write(frame[:])
+	if err == nil {
+		_, err = io.ReadFull(bucket.conn, frame[:])
+	}
+	if err != nil {
+		// the connection may hold a late answer, start over with a new one
+		bucket.conn.Close()
+		bucket.conn = nil
+		atomic.StoreInt64(&bucket.failedUntil, now.Add(bucket.retryDelay).UnixNano())
+		return 0, err
+	}
+	atomic.AddInt64(&bucket.leased, int64(binary.BigEndian.Uint64(frame[:])))
+	return bucket.take(min, max), nil
+}
+
+// take removes up to max tokens from the local lease, but nothing if it has fewer than min
+func (bucket *RemoteBucket) take(min int64, max int64) int64 {
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.leased)
+		granted := max
+		if currentTokens < granted {
+			granted = currentTokens
+		}
+		if granted < min || granted <= 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&bucket.leased, currentTokens, currentTokens-granted) {
+			return granted
+		}
+	}
+}
+
+func (bucket *RemoteBucket) allow(min int64, max int64, now time.Time) int64 {
+	if granted := bucket.take(min, max); granted > 0 {
+		return granted
+	}
+	if now.UnixNano() < atomic.LoadInt64(&bucket.failedUntil) {
+		return bucket.unreachable(max)
+	}
+
+	granted, err := bucket.lease(min, max, now)
+	if err != nil {
+		return bucket.unreachable(max)
+	}
+	return granted
+}
+
+func (bucket *RemoteBucket) unreachable(max int64) int64 {
+	if bucket.policy == FailOpen {
+		return max
+	}
+	return 0
+}
+
+func (bucket *RemoteBucket) IsAllowed(amount int64, now time.Time) bool {
+	return amount <= 0 || bucket.allow(amount, amount, now) == amount
+}
+
+func (bucket *RemoteBucket) AllowUpTo(max int64, now time.Time) int64 {
+	return bucket.allow(1, max, now)
+}
+
+// the tokens go back into the local lease, the root never sees them again
+func (bucket *RemoteBucket) ReturnTokens(amount int64) {
+	atomic.AddInt64(&bucket.leased, amount)
+}
+
+// the rate is owned by the root, a host can not change it
+func (bucket *RemoteBucket) SetRefillRate(refillRate float64) {
+}
+
+func (bucket *RemoteBucket) GetCapacity() int64 {
+	return bucket.leaseSize
+}
+
+// GetTokens only knows the leased tokens, the root may hold more
+func (bucket *RemoteBucket) GetTokens() int64 {
+	return atomic.LoadInt64(&bucket.leased)
+}
+
+func (bucket *RemoteBucket) Close() error {
+	bucket.Lock()
+	defer bucket.Unlock()
+	if bucket.conn == nil {
+		return nil
+	}
+	err := bucket.conn.Close()
+	bucket.conn = nil
+	return err
+}
+
+// NewDistributedStepwell builds a local StepWell whose root node is the remote bucket, all other nodes
+// are local buckets of bucketType
+func NewDistributedStepwell(numCores uint64, now time.Time, bucketType int, capacity int64, refillRate float64, root *RemoteBucket) *stepwell.StepWell {
+	return stepwell.NewStepwellWithBuckets(numCores, capacity, refillRate, func(index int) tokenbucket.TokenBucketInterface {
+		if index == 0 {
+			return root
+		}
+		return tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now)
+	})
+}
+
+var _ tokenbucket.TokenBucketInterface = (*RemoteBucket)(nil)
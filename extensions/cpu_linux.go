@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package extensions
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// CurrentCore returns the CPU the calling thread is running on right now. The goroutine may
+// be moved to another CPU right after, so the result must only be used as a hint.
+// It makes a real getcpu syscall, hot paths should use ShardHint instead.
+func CurrentCore() int {
+	var cpu uint32
+	_, _, errno := unix.RawSyscall(unix.SYS_GETCPU, uintptr(unsafe.Pointer(&cpu)), 0, 0)
+	if errno != 0 {
+		return 0
+	}
+	return int(cpu)
+}
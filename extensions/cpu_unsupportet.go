@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package extensions
+
+import (
+	"math/rand"
+	"runtime"
+)
+
+// CurrentCore can not ask the OS on this platform, so it spreads callers randomly over the available CPUs
+func CurrentCore() int {
+	return rand.Intn(runtime.NumCPU())
+}
@@ -0,0 +1,28 @@
+package extensions
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var numHints int64
+
+// hints keeps a small id per P: sync.Pool serves Get from the pool of the current P, so a goroutine
+// mostly gets back the id the last goroutine on its P put there
+var hints = sync.Pool{
+	New: func() any {
+		hint := int(atomic.AddInt64(&numHints, 1) - 1)
+		return &hint
+	},
+}
+
+// ShardHint returns a small number which stays the same for the goroutines running on the same P most
+// of the time, so concurrent callers spread over shards like with the CPU id. It costs a few nanoseconds
+// instead of the getcpu syscall of CurrentCore. The hint grows after the garbage collector emptied the
+// pool, callers take it modulo their number of shards.
+func ShardHint() int {
+	hint := hints.Get().(*int)
+	value := *hint
+	hints.Put(hint)
+	return value
+}
@@ -2,4 +2,4 @@ module stepwell
 
 go 1.21.3
 
-require golang.org/x/sys v0.20.0 // indirect
+require golang.org/x/sys v0.20.0
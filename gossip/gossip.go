@@ -0,0 +1,270 @@
+// Cluster-wide rate sharing without a central server: the StepWellPlus rebalancing across cores,
+// applied across processes. Every instance gossips its demand to its peers over UDP and takes the
+// share of the global refill rate which matches its share of the total demand.
+//
+// Packet (24 bytes, big endian): instance id uint64 | sequence number uint64 | demand in tokens/s as float64 bits
+
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"stepwell/stepwellplus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const packetSize = 24
+
+type Config struct {
+	// UDP address this instance listens on
+	Addr  string
+	Peers []string
+	// the rate all instances together may hand out
+	GlobalRefillRate float64
+	// how often the demand is measured and sent to the peers
+	Interval time.Duration
+	// peers which were not heard of for PeerTimeout do not count anymore
+	PeerTimeout time.Duration
+	// weight of the newest measurement in the smoothed demand, between 0 and 1
+	Smoothing float64
+	// every instance gets at least MinShare of an even split, so an idle instance can still serve its first requests
+	MinShare float64
+	// drops this share of the outgoing packets to simulate a lossy network
+	LossRate float64
+}
+
+type peerState struct {
+	demand   float64
+	seq      uint64
+	lastSeen time.Time
+}
+
+type Node struct {
+	config       Config
+	stepwellplus *stepwellplus.StepWellPlus
+	id           uint64
+	conn         *net.UDPConn
+	peerAddrs    []*net.UDPAddr
+	// tokens requested since the last interval
+	requested int64
+	demand    float64
+	seq       uint64
+	peers     map[uint64]*peerState
+	running   bool
+	stopChan  chan struct{}
+	wait      sync.WaitGroup
+	sync.Mutex
+}
+
+func NewNode(config Config, stepwellplus *stepwellplus.StepWellPlus) (*Node, error) {
+	if config.Interval <= 0 {
+		config.Interval = 100 * time.Millisecond
+	}
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = 10 * config.Interval
+	}
+	if config.Smoothing <= 0 || config.Smoothing > 1 {
+		config.Smoothing = 0.5
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	var peerAddrs []*net.UDPAddr
+	for _, peer := range config.Peers {
+		peerAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, err
+		}
+		peerAddrs = append(peerAddrs, peerAddr)
+	}
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &Node{
+		config:       config,
+		stepwellplus: stepwellplus,
+		id:           rand.Uint64(),
+		conn:         conn,
+		peerAddrs:    peerAddrs,
+		peers:        make(map[uint64]*peerState),
+		stopChan:     make(chan struct{}),
+	}
+	// until the first round is over every instance assumes an even split
+	stepwellplus.SetRefillRate(config.GlobalRefillRate / float64(len(peerAddrs)+1))
+	return node, nil
+}
+
+func (node *Node) IsAllowed(port uint64, amount int64, now time.Time) bool {
+	atomic.AddInt64(&node.requested, amount)
+	return node.stepwellplus.IsAllowed(port, amount, now)
+}
+
+func (node *Node) GetRefillRate() float64 {
+	node.Lock()
+	defer node.Unlock()
+	return node.stepwellplus.GetRefillRate()
+}
+
+// GetDemand returns the smoothed demand of this instance in tokens per second
+func (node *Node) GetDemand() float64 {
+	node.Lock()
+	defer node.Unlock()
+	return node.demand
+}
+
+// GetTotalDemand returns the demand of the whole cluster as this instance sees it, its own smoothed
+// demand plus the last demand of every peer it heard of recently
+func (node *Node) GetTotalDemand() float64 {
+	node.Lock()
+	defer node.Unlock()
+	total := node.demand
+	for _, peer := range node.peers {
+		total += peer.demand
+	}
+	return total
+}
+
+func (node *Node) Start() {
+	node.Lock()
+	defer node.Unlock()
+	if node.running {
+		return
+	}
+	node.running = true
+	node.stopChan = make(chan struct{})
+
+	node.wait.Add(2)
+	go node.receive()
+	go node.run()
+}
+
+// Stop closes the socket, a stopped node can not be started again
+func (node *Node) Stop() error {
+	node.Lock()
+	if !node.running {
+		node.Unlock()
+		return errors.New("gossip node is not running")
+	}
+	node.running = false
+	close(node.stopChan)
+	node.Unlock()
+
+	err := node.conn.Close()
+	node.wait.Wait()
+	return err
+}
+
+func (node *Node) receive() {
+	defer node.wait.Done()
+	buffer := make([]byte, packetSize)
+	for {
+		n, _, err := node.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-node.stopChan:
+				return
+			default:
+				continue
+			}
+		}
+		if n != packetSize {
+			continue
+		}
+		id := binary.BigEndian.Uint64(buffer[0:])
+		seq := binary.BigEndian.Uint64(buffer[8:])
+		demand := math.Float64frombits(binary.BigEndian.Uint64(buffer[16:]))
+		if id == node.id {
+			continue
+		}
+
+		node.Lock()
+		peer, ok := node.peers[id]
+		if !ok {
+			peer = &peerState{}
+			node.peers[id] = peer
+		}
+		// packets may be reordered, an older measurement never replaces a newer one
+		if !ok || seq > peer.seq {
+			peer.demand = demand
+			peer.seq = seq
+			peer.lastSeen = time.Now()
+		}
+		node.Unlock()
+	}
+}
+
+func (node *Node) run() {
+	defer node.wait.Done()
+	ticker := time.NewTicker(node.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-node.stopChan:
+			return
+		case now := <-ticker.C:
+			node.round(now)
+		}
+	}
+}
+
+// round measures the local demand, sends it to all peers and recomputes the local share
+func (node *Node) round(now time.Time) {
+	requested := atomic.SwapInt64(&node.requested, 0)
+	measured := float64(requested) / node.config.Interval.Seconds()
+
+	node.Lock()
+	node.demand = node.config.Smoothing*measured + (1-node.config.Smoothing)*node.demand
+	node.seq++
+	packet := make([]byte, packetSize)
+	binary.BigEndian.PutUint64(packet[0:], node.id)
+	binary.BigEndian.PutUint64(packet[8:], node.seq)
+	binary.BigEndian.PutUint64(packet[16:], math.Float64bits(node.demand))
+
+	demands := []float64{node.demand}
+	for id, peer := range node.peers {
+		if now.Sub(peer.lastSeen) > node.config.PeerTimeout {
+			delete(node.peers, id)
+			continue
+		}
+		demands = append(demands, peer.demand)
+	}
+	refillRate := share(node.config.GlobalRefillRate, node.config.MinShare, demands)
+	node.stepwellplus.SetRefillRate(refillRate)
+	node.Unlock()
+
+	for _, peerAddr := range node.peerAddrs {
+		if node.config.LossRate > 0 && rand.Float64() < node.config.LossRate {
+			continue
+		}
+		node.conn.WriteToUDP(packet, peerAddr)
+	}
+}
+
+// share returns the part of globalRate belonging to demands[0]. Every demand is raised to at least
+// minShare of the average demand first, all instances with the same view compute shares which sum up to globalRate.
+func share(globalRate float64, minShare float64, demands []float64) float64 {
+	total := 0.0
+	for _, demand := range demands {
+		total += demand
+	}
+	if total <= 0 {
+		return globalRate / float64(len(demands))
+	}
+
+	floor := minShare * total / float64(len(demands))
+	weightedTotal := 0.0
+	for _, demand := range demands {
+		weightedTotal += math.Max(demand, floor)
+	}
+	return globalRate * math.Max(demands[0], floor) / weightedTotal
+}
@@ -0,0 +1,182 @@
+// Hierarchical token bucket with the class semantics of Linux tc HTB: https://man7.org/linux/man-pages/man8/tc-htb.8.html
+// Unlike StepWell, where every node is a hard cap, a class may borrow spare tokens from its parents up to its ceil.
+
+package htb
+
+import (
+	"errors"
+	"stepwell/tokenbucket"
+	"sync"
+	"time"
+)
+
+// tc knows the priorities 0 (highest) to 7 (lowest)
+const NumPrios = 8
+
+type Class struct {
+	ID string
+	// guaranteed rate, never borrowed
+	rate tokenbucket.TokenBucketInterface
+	// the class never exceeds its ceil, not even with borrowed tokens
+	ceil   tokenbucket.TokenBucketInterface
+	prio   int
+	parent *Class
+	// the class itself followed by all its parents up to the top level class
+	path []*Class
+	// per prio the Unix timestamp in nanoseconds when a borrower last found the rate bucket of this class empty
+	backlogged [NumPrios]int64
+}
+
+type HTB struct {
+	classes    map[string]*Class
+	bucketType int
+	// how long a borrower which found a lender empty keeps lower priorities away from it
+	backlogWindow time.Duration
+	// one lock for the whole hierarchy, like the qdisc lock in the kernel: borrowing touches buckets
+	// of several classes which have to be charged or rolled back together
+	sync.Mutex
+}
+
+type charge struct {
+	bucket tokenbucket.TokenBucketInterface
+	amount int64
+}
+
+func NewHTB(bucketType int) *HTB {
+	return &HTB{
+		classes:       make(map[string]*Class),
+		bucketType:    bucketType,
+		backlogWindow: 100 * time.Millisecond,
+	}
+}
+
+// SetBacklogWindow changes how long a class with a higher priority stays backlogged at a lender after it
+// found the lender empty. Longer windows favour the higher priorities more, shorter windows lend sooner again.
+func (htb *HTB) SetBacklogWindow(window time.Duration) {
+	htb.Lock()
+	defer htb.Unlock()
+	htb.backlogWindow = window
+}
+
+// AddClass adds a class below parentID, an empty parentID adds a top level class.
+// burst and cburst are the capacities of the rate and ceil bucket.
+func (htb *HTB) AddClass(id string, parentID string, rate float64, burst int64, ceil float64, cburst int64, prio int, now time.Time) (*Class, error) {
+	htb.Lock()
+	defer htb.Unlock()
+
+	if _, exists := htb.classes[id]; exists {
+		return nil, errors.New("class " + id + " already exists")
+	}
+	if ceil < rate {
+		return nil, errors.New("ceil of class " + id + " is lower than its rate")
+	}
+	if prio < 0 || prio >= NumPrios {
+		return nil, errors.New("prio of class " + id + " is out of range")
+	}
+
+	var parent *Class
+	if parentID != "" {
+		var ok bool
+		if parent, ok = htb.classes[parentID]; !ok {
+			return nil, errors.New("parent class " + parentID + " does not exist")
+		}
+	}
+
+	class := &Class{
+		ID:     id,
+		rate:   tokenbucket.NewTokenBucketByType(htb.bucketType, burst, rate, now),
+		ceil:   tokenbucket.NewTokenBucketByType(htb.bucketType, cburst, ceil, now),
+		prio:   prio,
+		parent: parent,
+	}
+	class.path = append([]*Class{class}, parentPath(parent)...)
+	htb.classes[id] = class
+	return class, nil
+}
+
+func parentPath(parent *Class) []*Class {
+	if parent == nil {
+		return nil
+	}
+	return parent.path
+}
+
+func (htb *HTB) GetClass(id string) *Class {
+	htb.Lock()
+	defer htb.Unlock()
+	return htb.classes[id]
+}
+
+func rollback(charged []charge) {
+	for _, c := range charged {
+		c.bucket.ReturnTokens(c.amount)
+	}
+}
+
+// IsAllowed walks from the class towards the top level until it finds a class with enough tokens in its
+// rate bucket (the lender). Every class on the way borrows and is only charged on its ceil. The lender and
+// all classes above it are charged on their rate as well, so the traffic counts against the aggregate
+// guarantee of every parent. Such a parent may already be empty, then it only gets what it has left.
+//
+// Priorities order the borrowers like tc does: a lender gives all its spare tokens to whoever asks, unless a
+// class with a higher priority found it empty within the backlog window. Then the lower priorities skip it,
+// so the tokens it refills go to the higher priority first.
+func (htb *HTB) IsAllowed(class *Class, amount int64, now time.Time) bool {
+	htb.Lock()
+	defer htb.Unlock()
+
+	var charged []charge
+	lender := -1
+	for i, curr := range class.path {
+		if !curr.ceil.IsAllowed(amount, now) {
+			rollback(charged)
+			return false
+		}
+		charged = append(charged, charge{bucket: curr.ceil, amount: amount})
+
+		if i > 0 && htb.higherPrioBacklogged(curr, class.prio, now) {
+			continue
+		}
+		if curr.rate.IsAllowed(amount, now) {
+			charged = append(charged, charge{bucket: curr.rate, amount: amount})
+			lender = i
+			break
+		}
+		if i > 0 {
+			curr.backlogged[class.prio] = now.UnixNano()
+		}
+	}
+	if lender < 0 {
+		rollback(charged)
+		return false
+	}
+
+	for _, curr := range class.path[lender+1:] {
+		if !curr.ceil.IsAllowed(amount, now) {
+			rollback(charged)
+			return false
+		}
+		charged = append(charged, charge{bucket: curr.ceil, amount: amount})
+		charged = append(charged, charge{bucket: curr.rate, amount: curr.rate.AllowUpTo(amount, now)})
+	}
+	return true
+}
+
+func (htb *HTB) IsAllowedByID(id string, amount int64, now time.Time) bool {
+	class := htb.GetClass(id)
+	if class == nil {
+		return false
+	}
+	return htb.IsAllowed(class, amount, now)
+}
+
+// higherPrioBacklogged reports whether a class with a higher priority than prio found lender empty recently
+func (htb *HTB) higherPrioBacklogged(lender *Class, prio int, now time.Time) bool {
+	since := now.UnixNano() - int64(htb.backlogWindow)
+	for higher := 0; higher < prio; higher++ {
+		if lender.backlogged[higher] != 0 && lender.backlogged[higher] > since {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// HTTP middleware which answers with 429 and the RateLimit headers of
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+
+package httplimit
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"stepwell/keyed"
+	"stepwell/stepwell"
+	"strconv"
+	"time"
+)
+
+// Decision carries the bucket state the response headers are computed from
+type Decision struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	RefillRate float64
+}
+
+type Limiter interface {
+	Allow(key string, amount int64, now time.Time) Decision
+}
+
+// KeyFunc extracts the client a request is charged to
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP charges every client IP separately
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader charges by the value of a header, e.g. an API key. Requests without the header fall back to their IP.
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+		return KeyByIP(r)
+	}
+}
+
+// StepWellLimiter hashes every key to a port, so a client always walks the same path of the StepWell tree
+type StepWellLimiter struct {
+	stepwell *stepwell.StepWell
+}
+
+func NewStepWellLimiter(stepwell *stepwell.StepWell) *StepWellLimiter {
+	return &StepWellLimiter{stepwell: stepwell}
+}
+
+func (limiter *StepWellLimiter) Allow(key string, amount int64, now time.Time) Decision {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	port := hash.Sum64() % limiter.stepwell.GetNumCores()
+
+	allowed := limiter.stepwell.IsAllowed(port, amount, now)
+	return Decision{
+		Allowed:    allowed,
+		Limit:      limiter.stepwell.Capacity,
+		Remaining:  limiter.stepwell.GetTokensAt(port, now),
+		RefillRate: limiter.stepwell.GetRefillRate(),
+	}
+}
+
+// KeyedLimiter gives every key its own bucket
+type KeyedLimiter struct {
+	keyed *keyed.KeyedLimiter
+}
+
+func NewKeyedLimiter(keyed *keyed.KeyedLimiter) *KeyedLimiter {
+	return &KeyedLimiter{keyed: keyed}
+}
+
+func (limiter *KeyedLimiter) Allow(key string, amount int64, now time.Time) Decision {
+	allowed := limiter.keyed.IsAllowed(key, 0, amount, now)
+	return Decision{
+		Allowed:    allowed,
+		Limit:      limiter.keyed.GetCapacity(),
+		Remaining:  limiter.keyed.GetTokens(key, 0, now),
+		RefillRate: limiter.keyed.GetRefillRate(),
+	}
+}
+
+type Middleware struct {
+	next    http.Handler
+	limiter Limiter
+	keyFunc KeyFunc
+	// tokens charged per request
+	Amount int64
+	// answers limited requests, the headers are already set when it is called
+	LimitedHandler http.Handler
+}
+
+func NewMiddleware(next http.Handler, limiter Limiter, keyFunc KeyFunc) *Middleware {
+	if keyFunc == nil {
+		keyFunc = KeyByIP
+	}
+	return &Middleware{
+		next:    next,
+		limiter: limiter,
+		keyFunc: keyFunc,
+		Amount:  1,
+		LimitedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}),
+	}
+}
+
+// secondsUntil returns how long it takes to refill the given number of tokens, rounded up to full seconds
+func secondsUntil(tokens int64, refillRate float64) int64 {
+	if tokens <= 0 {
+		return 0
+	}
+	if refillRate <= 0 {
+		return math.MaxInt32
+	}
+	return int64(math.Ceil(float64(tokens) / refillRate))
+}
+
+func (middleware *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	decision := middleware.limiter.Allow(middleware.keyFunc(r), middleware.Amount, time.Now())
+
+	remaining := decision.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.FormatInt(decision.Limit, 10))
+	header.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	// the bucket is back at its limit once the used tokens are refilled
+	header.Set("RateLimit-Reset", strconv.FormatInt(secondsUntil(decision.Limit-remaining, decision.RefillRate), 10))
+
+	if !decision.Allowed {
+		retryAfter := secondsUntil(middleware.Amount-remaining, decision.RefillRate)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		middleware.LimitedHandler.ServeHTTP(w, r)
+		return
+	}
+	middleware.next.ServeHTTP(w, r)
+}
+
+var _ Limiter = (*StepWellLimiter)(nil)
+var _ Limiter = (*KeyedLimiter)(nil)
+var _ http.Handler = (*Middleware)(nil)
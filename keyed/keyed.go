@@ -0,0 +1,247 @@
+package keyed
+
+import (
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+type KeyedLimiterInterface interface {
+	IsAllowed(key string, port uint64, amount int64, now time.Time) bool
+	AllowUpTo(key string, port uint64, max int64, now time.Time) int64
+}
+
+// Config is the template every lazily created limiter is built from
+type Config struct {
+	BucketType int
+	Capacity   int64
+	RefillRate float64
+	// Hot keys get a whole StepWell with NumCores leaves instead of a single bucket, so their
+	// requests do not all hit the same word. A nil IsHot treats every key as cold.
+	NumCores uint64
+	IsHot    func(key string) bool
+	// Keys which were not seen for TTL are removed by Sweep, 0 keeps them until they are evicted
+	TTL time.Duration
+	// Hard cap on tracked keys, the least recently used keys are evicted to stay below it. 0 means unlimited.
+	MaxKeys int
+	// How often the worker calls Sweep
+	SweepDelay time.Duration
+}
+
+// a single bucket behind the same interface as a StepWell, the port is ignored
+type bucketLimiter struct {
+	bucket tokenbucket.TokenBucketInterface
+}
+
+func (limiter *bucketLimiter) IsAllowed(port uint64, amount int64, now time.Time) bool {
+	return limiter.bucket.IsAllowed(amount, now)
+}
+
+func (limiter *bucketLimiter) AllowUpTo(port uint64, max int64, now time.Time) int64 {
+	return limiter.bucket.AllowUpTo(max, now)
+}
+
+func (limiter *bucketLimiter) AllowBetween(port uint64, min int64, max int64, now time.Time) int64 {
+	return tokenbucket.AllowBetween(limiter.bucket, min, max, now)
+}
+
+func (limiter *bucketLimiter) GetTokens(port uint64) int64 {
+	return limiter.bucket.GetTokens()
+}
+
+func (limiter *bucketLimiter) GetTokensAt(port uint64, now time.Time) int64 {
+	return tokenbucket.GetTokensAt(limiter.bucket, now)
+}
+
+type entry struct {
+	limiter stepwell.StepWellInterface
+	// Store as Unix timestamp to be able to use atomic operations
+	lastSeen int64
+}
+
+// lastSeen is only written when it is at least this much out of date, so a hot key
+// does not bounce the cache line between cores on every request
+const lastSeenResolution = int64(time.Millisecond)
+
+// how many entries are looked at to find an eviction victim, like the approximated LRU of Redis
+const evictionSamples = 16
+
+// KeyedLimiter creates a limiter per key on first use. Lookups go through a sync.Map and only
+// touch shared state when a key is created or evicted.
+type KeyedLimiter struct {
+	config        Config
+	entries       sync.Map
+	numKeys       int64
+	workerRunning bool
+	stopChan      chan struct{}
+}
+
+func NewKeyedLimiter(config Config) *KeyedLimiter {
+	if config.NumCores <= 0 {
+		config.NumCores = 1
+	}
+	if config.SweepDelay <= 0 {
+		config.SweepDelay = time.Second
+	}
+	return &KeyedLimiter{
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (keyed *KeyedLimiter) newEntry(key string, now time.Time) *entry {
+	var limiter stepwell.StepWellInterface
+	if keyed.config.IsHot != nil && keyed.config.IsHot(key) {
+		limiter = stepwell.NewStepwell(keyed.config.NumCores, now, keyed.config.BucketType, keyed.config.Capacity, keyed.config.RefillRate)
+	} else {
+		limiter = &bucketLimiter{bucket: tokenbucket.NewTokenBucketByType(keyed.config.BucketType, keyed.config.Capacity, keyed.config.RefillRate, now)}
+	}
+	return &entry{limiter: limiter, lastSeen: now.UnixNano()}
+}
+
+// load returns the limiter of a tracked key or nil
+func (keyed *KeyedLimiter) load(key string, now time.Time) stepwell.StepWellInterface {
+	value, ok := keyed.entries.Load(key)
+	if !ok {
+		return nil
+	}
+	e := value.(*entry)
+	nowUnix := now.UnixNano()
+	if nowUnix-atomic.LoadInt64(&e.lastSeen) > lastSeenResolution {
+		atomic.StoreInt64(&e.lastSeen, nowUnix)
+	}
+	return e.limiter
+}
+
+// Get returns the limiter of key and creates it if the key is not tracked yet
+func (keyed *KeyedLimiter) Get(key string, now time.Time) stepwell.StepWellInterface {
+	if limiter := keyed.load(key, now); limiter != nil {
+		return limiter
+	}
+
+	value, loaded := keyed.entries.LoadOrStore(key, keyed.newEntry(key, now))
+	if !loaded && atomic.AddInt64(&keyed.numKeys, 1) > int64(keyed.config.MaxKeys) && keyed.config.MaxKeys > 0 {
+		keyed.evict(key)
+	}
+	return value.(*entry).limiter
+}
+
+// GetBytes is Get without converting key to a string for keys which are already tracked. The lookup
+// does not keep the string, only a new key is copied before it is stored.
+func (keyed *KeyedLimiter) GetBytes(key []byte, now time.Time) stepwell.StepWellInterface {
+	if len(key) > 0 {
+		if limiter := keyed.load(unsafe.String(&key[0], len(key)), now); limiter != nil {
+			return limiter
+		}
+	}
+	return keyed.Get(string(key), now)
+}
+
+func (keyed *KeyedLimiter) delete(key string, e *entry) bool {
+	if keyed.entries.CompareAndDelete(key, e) {
+		atomic.AddInt64(&keyed.numKeys, -1)
+		return true
+	}
+	return false
+}
+
+// evict removes keys until the cap holds again. Every victim is the least recently used key of a small
+// random sample, the key which triggered the eviction is never picked.
+func (keyed *KeyedLimiter) evict(keep string) {
+	for atomic.LoadInt64(&keyed.numKeys) > int64(keyed.config.MaxKeys) {
+		victimKey := ""
+		var victim *entry
+		samples := 0
+		keyed.entries.Range(func(k, v any) bool {
+			e := v.(*entry)
+			if k.(string) != keep && (victim == nil || atomic.LoadInt64(&e.lastSeen) < atomic.LoadInt64(&victim.lastSeen)) {
+				victimKey = k.(string)
+				victim = e
+			}
+			samples++
+			return samples < evictionSamples
+		})
+		if victim == nil {
+			return
+		}
+		// another goroutine may have evicted the same victim, then the next sample is taken
+		keyed.delete(victimKey, victim)
+	}
+}
+
+func (keyed *KeyedLimiter) IsAllowed(key string, port uint64, amount int64, now time.Time) bool {
+	return keyed.Get(key, now).IsAllowed(port, amount, now)
+}
+
+func (keyed *KeyedLimiter) AllowUpTo(key string, port uint64, max int64, now time.Time) int64 {
+	return keyed.Get(key, now).AllowUpTo(port, max, now)
+}
+
+func (keyed *KeyedLimiter) GetTokens(key string, port uint64, now time.Time) int64 {
+	return keyed.Get(key, now).GetTokensAt(port, now)
+}
+
+func (keyed *KeyedLimiter) GetCapacity() int64 {
+	return keyed.config.Capacity
+}
+
+func (keyed *KeyedLimiter) GetRefillRate() float64 {
+	return keyed.config.RefillRate
+}
+
+func (keyed *KeyedLimiter) Len() int {
+	return int(atomic.LoadInt64(&keyed.numKeys))
+}
+
+// Sweep removes all keys which were idle for longer than the TTL
+func (keyed *KeyedLimiter) Sweep(now time.Time) {
+	if keyed.config.TTL <= 0 {
+		return
+	}
+	deadline := now.UnixNano() - int64(keyed.config.TTL)
+	keyed.entries.Range(func(k, v any) bool {
+		e := v.(*entry)
+		if atomic.LoadInt64(&e.lastSeen) < deadline {
+			keyed.delete(k.(string), e)
+		}
+		return true
+	})
+}
+
+func (keyed *KeyedLimiter) StartWorker() {
+	if keyed.workerRunning {
+		return
+	}
+	keyed.workerRunning = true
+	keyed.stopChan = make(chan struct{})
+
+	go keyed.startWorkerCore()
+}
+
+func (keyed *KeyedLimiter) StopWorker() {
+	if !keyed.workerRunning {
+		return
+	}
+	keyed.workerRunning = false
+
+	close(keyed.stopChan)
+}
+
+func (keyed *KeyedLimiter) startWorkerCore() {
+	ticker := time.NewTicker(keyed.config.SweepDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-keyed.stopChan:
+			return
+		case now := <-ticker.C:
+			keyed.Sweep(now)
+		}
+	}
+}
+
+var _ KeyedLimiterInterface = (*KeyedLimiter)(nil)
@@ -2,12 +2,52 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"stepwell/distributed"
+	"stepwell/resp"
+	"stepwell/server"
 	"stepwell/test"
+	"stepwell/unixsock"
 	"strconv"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "resp" {
+		serveRESP()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "unix" {
+		serveUnix()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "root" {
+		serveRoot()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "leaf" {
+		runLeaf()
+		return
+	}
+
+	// tests which need no parameters fail the process if they do not pass
+	checks := map[string]func() error{
+		"TestHTTPLimit": test.TestHTTPLimit,
+		"TestSchedule":  test.TestSchedule,
+	}
+	if len(os.Args) > 1 && checks[os.Args[1]] != nil {
+		if err := checks[os.Args[1]](); err != nil {
+			fmt.Println("Test failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) < 7 { // Ensure there are at least four arguments
 		fmt.Println("Usage: go run main.go <testType> <numCores> <bucketType> <duration> <refillRate> <capacity>")
 		os.Exit(1)
@@ -63,8 +103,153 @@ func main() {
 		test.TestStepWellPerformance(numCores, bucketType, duration, refillRateInt, capacityInt)
 	case "TestTokenBucketPerformance":
 		test.TestTokenBucketPerformance(numCores, bucketType, duration, refillRateInt, capacityInt)
+	case "TestGossipConvergence":
+		if err := test.TestGossipConvergence(numCores, bucketType, duration, refillRateInt, capacityInt); err != nil {
+			fmt.Println("Test failed:", err)
+			os.Exit(1)
+		}
+	case "TestDistributed":
+		if err := test.TestDistributed(int(numCores), bucketType, duration, refillRateInt, capacityInt); err != nil {
+			fmt.Println("Test failed:", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Printf("Unknown test type: %s\n", testType)
 		os.Exit(1)
 	}
 }
+
+func serve() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: go run main.go serve <address> <config.json>")
+		os.Exit(1)
+	}
+
+	config, err := server.LoadConfig(os.Args[3])
+	if err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Serving limits on %s\n", os.Args[2])
+	if err := server.ListenAndServe(os.Args[2], config); err != nil {
+		fmt.Println("Server failed:", err)
+		os.Exit(1)
+	}
+}
+
+func serveRESP() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: go run main.go resp <address>")
+		os.Exit(1)
+	}
+
+	fmt.Printf("Serving CL.THROTTLE on %s\n", os.Args[2])
+	if err := resp.ListenAndServe(os.Args[2]); err != nil {
+		fmt.Println("Server failed:", err)
+		os.Exit(1)
+	}
+}
+
+func serveUnix() {
+	if len(os.Args) < 7 {
+		fmt.Println("Usage: go run main.go unix <socket> <numCores> <bucketType> <capacity> <refillRate>")
+		os.Exit(1)
+	}
+
+	numCores, err := strconv.ParseUint(os.Args[3], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid number of cores:", os.Args[3])
+		os.Exit(1)
+	}
+	bucketType, err := strconv.Atoi(os.Args[4])
+	if err != nil {
+		fmt.Println("Invalid bucket type:", os.Args[4])
+		os.Exit(1)
+	}
+	capacity, err := strconv.ParseInt(os.Args[5], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid capacity:", os.Args[5])
+		os.Exit(1)
+	}
+	refillRate, err := strconv.ParseFloat(os.Args[6], 64)
+	if err != nil {
+		fmt.Println("Invalid refill rate:", os.Args[6])
+		os.Exit(1)
+	}
+
+	server := unixsock.NewServer(unixsock.Config{
+		NumCores:   numCores,
+		BucketType: bucketType,
+		Capacity:   capacity,
+		RefillRate: refillRate,
+		PinThreads: true,
+		ErrorLog:   log.New(os.Stderr, "", log.LstdFlags),
+	})
+	fmt.Printf("Serving limits on %s\n", os.Args[2])
+	if err := server.ListenAndServe(os.Args[2]); err != nil {
+		fmt.Println("Server failed:", err)
+		os.Exit(1)
+	}
+}
+
+func serveRoot() {
+	if len(os.Args) < 6 {
+		fmt.Println("Usage: go run main.go root <address> <bucketType> <capacity> <refillRate>")
+		os.Exit(1)
+	}
+
+	bucketType, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		fmt.Println("Invalid bucket type:", os.Args[3])
+		os.Exit(1)
+	}
+	capacity, err := strconv.ParseInt(os.Args[4], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid capacity:", os.Args[4])
+		os.Exit(1)
+	}
+	refillRate, err := strconv.ParseFloat(os.Args[5], 64)
+	if err != nil {
+		fmt.Println("Invalid refill rate:", os.Args[5])
+		os.Exit(1)
+	}
+
+	root := distributed.NewRootServer(bucketType, capacity, refillRate, time.Now())
+	fmt.Printf("Serving root bucket on %s\n", os.Args[2])
+	if err := root.ListenAndServe(os.Args[2]); err != nil {
+		fmt.Println("Server failed:", err)
+		os.Exit(1)
+	}
+}
+
+func runLeaf() {
+	if len(os.Args) < 7 {
+		fmt.Println("Usage: go run main.go leaf <rootAddress> <numCores> <bucketType> <leaseSize> <duration>")
+		os.Exit(1)
+	}
+
+	numCores, err := strconv.ParseUint(os.Args[3], 10, 64)
+	if err != nil || numCores == 0 {
+		fmt.Println("Invalid number of cores:", os.Args[3])
+		os.Exit(1)
+	}
+	bucketType, err := strconv.Atoi(os.Args[4])
+	if err != nil {
+		fmt.Println("Invalid bucket type:", os.Args[4])
+		os.Exit(1)
+	}
+	leaseSize, err := strconv.ParseInt(os.Args[5], 10, 64)
+	if err != nil {
+		fmt.Println("Invalid lease size:", os.Args[5])
+		os.Exit(1)
+	}
+	duration, err := strconv.Atoi(os.Args[6])
+	if err != nil {
+		fmt.Println("Invalid duration:", os.Args[6])
+		os.Exit(1)
+	}
+
+	allowed := test.RunDistributedLeaf(os.Args[2], numCores, bucketType, leaseSize, time.Duration(duration)*time.Second)
+	fmt.Printf("Allowed: %d\n", allowed)
+}
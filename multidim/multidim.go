@@ -0,0 +1,135 @@
+package multidim
+
+import (
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"time"
+)
+
+// Every request carries a cost vector with one entry per dimension, e.g. {1 packet, 1500 bytes}.
+// A request is only allowed if every dimension allows it, and then all of them are charged.
+// A cost vector whose length does not match the number of dimensions or with a negative cost is denied.
+type MultiLimiterInterface interface {
+	IsAllowed(costs []int64, now time.Time) bool
+}
+
+type MultiStepWellInterface interface {
+	IsAllowed(port uint64, costs []int64, now time.Time) bool
+}
+
+// a negative cost would add tokens to its dimension instead of charging it
+func validCosts(costs []int64, numDimensions int) bool {
+	if len(costs) != numDimensions {
+		return false
+	}
+	for _, cost := range costs {
+		if cost < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type charge struct {
+	bucket tokenbucket.TokenBucketInterface
+	amount int64
+}
+
+// A denied dimension gives back the tokens of all dimensions charged before it. Concurrent requests may
+// see those tokens missing for a short moment, but no request ever ends up charging only a part of its costs.
+func rollback(charged []charge) {
+	for _, c := range charged {
+		c.bucket.ReturnTokens(c.amount)
+	}
+}
+
+type MultiTokenBucket struct {
+	// one bucket per dimension, the buckets may be of different bucketTypes
+	Buckets []tokenbucket.TokenBucketInterface
+}
+
+func NewMultiTokenBucket(bucketTypes []int, capacities []int64, refillRates []float64, now time.Time) *MultiTokenBucket {
+	if len(bucketTypes) == 0 || len(bucketTypes) != len(capacities) || len(bucketTypes) != len(refillRates) {
+		return nil
+	}
+
+	buckets := make([]tokenbucket.TokenBucketInterface, len(bucketTypes))
+	for i := range bucketTypes {
+		buckets[i] = tokenbucket.NewTokenBucketByType(bucketTypes[i], capacities[i], refillRates[i], now)
+	}
+	return &MultiTokenBucket{Buckets: buckets}
+}
+
+func (multi *MultiTokenBucket) IsAllowed(costs []int64, now time.Time) bool {
+	if !validCosts(costs, len(multi.Buckets)) {
+		return false
+	}
+	charged := make([]charge, 0, len(multi.Buckets))
+	for i, bucket := range multi.Buckets {
+		// a dimension without costs for this request is not touched
+		if costs[i] == 0 {
+			continue
+		}
+		if !bucket.IsAllowed(costs[i], now) {
+			rollback(charged)
+			return false
+		}
+		charged = append(charged, charge{bucket: bucket, amount: costs[i]})
+	}
+	return true
+}
+
+// MultiStepWell keeps one StepWell per dimension. All of them are built for the same number of cores, so
+// they have the same shape and walking them in lockstep is the same as having a bucket per dimension in every node.
+type MultiStepWell struct {
+	Dimensions []*stepwell.StepWell
+	numCores   uint64
+}
+
+func NewMultiStepwell(numCores uint64, now time.Time, bucketTypes []int, capacities []int64, refillRates []float64) *MultiStepWell {
+	if numCores <= 0 || len(bucketTypes) == 0 || len(bucketTypes) != len(capacities) || len(bucketTypes) != len(refillRates) {
+		return nil
+	}
+
+	dimensions := make([]*stepwell.StepWell, len(bucketTypes))
+	for i := range bucketTypes {
+		dimensions[i] = stepwell.NewStepwell(numCores, now, bucketTypes[i], capacities[i], refillRates[i])
+	}
+	return &MultiStepWell{
+		Dimensions: dimensions,
+		numCores:   numCores,
+	}
+}
+
+// Unlike StepWell.IsAllowed a denial anywhere on the path gives back the tokens taken further down the path,
+// otherwise a large cost in one dimension would drain the leaf buckets of all the other dimensions
+func (multi *MultiStepWell) IsAllowed(port uint64, costs []int64, now time.Time) bool {
+	if !validCosts(costs, len(multi.Dimensions)) {
+		return false
+	}
+	nodes := make([]*stepwell.StepWellNode, len(multi.Dimensions))
+	for i, dimension := range multi.Dimensions {
+		nodes[i] = dimension.Cores[port]
+	}
+
+	var charged []charge
+	for nodes[0] != nil {
+		for i, node := range nodes {
+			if costs[i] == 0 {
+				continue
+			}
+			if !node.TokenBucket.IsAllowed(costs[i], now) {
+				rollback(charged)
+				return false
+			}
+			charged = append(charged, charge{bucket: node.TokenBucket, amount: costs[i]})
+		}
+		for i := range nodes {
+			nodes[i] = nodes[i].Parent
+		}
+	}
+	return true
+}
+
+var _ MultiLimiterInterface = (*MultiTokenBucket)(nil)
+var _ MultiStepWellInterface = (*MultiStepWell)(nil)
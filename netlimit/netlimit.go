@@ -0,0 +1,101 @@
+// Throttling of accepted connections for TCP front ends
+
+package netlimit
+
+import (
+	"net"
+	"stepwell/keyed"
+	"stepwell/tokenbucket"
+	"time"
+)
+
+type Mode int
+
+const (
+	// Reject accepts excess connections and closes them right away
+	Reject Mode = iota
+	// Delay stops accepting until the global bucket has a token again, the excess connections
+	// wait in the backlog of the kernel. Connections over the limit of their IP are still closed,
+	// waiting for a single IP would stall the accept loop for everyone else.
+	Delay
+)
+
+// an empty global bucket is polled again after a delay which doubles up to maxWait
+const (
+	minWait = 100 * time.Microsecond
+	maxWait = 10 * time.Millisecond
+)
+
+type Listener struct {
+	net.Listener
+	mode Mode
+	// connections per second over all clients, nil means unlimited
+	global tokenbucket.TokenBucketInterface
+	// connections per second per source IP, nil means unlimited
+	perIP *keyed.KeyedLimiter
+}
+
+func NewListener(listener net.Listener, mode Mode, global tokenbucket.TokenBucketInterface, perIP *keyed.KeyedLimiter) *Listener {
+	return &Listener{
+		Listener: listener,
+		mode:     mode,
+		global:   global,
+		perIP:    perIP,
+	}
+}
+
+func (listener *Listener) waitGlobal() {
+	wait := minWait
+	for !listener.global.IsAllowed(1, time.Now()) {
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+func sourceIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (listener *Listener) Accept() (net.Conn, error) {
+	for {
+		if listener.global != nil && listener.mode == Delay {
+			listener.waitGlobal()
+		}
+
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			if listener.global != nil && listener.mode == Delay {
+				listener.global.ReturnTokens(1)
+			}
+			return nil, err
+		}
+		now := time.Now()
+
+		globalCharged := listener.global != nil && listener.mode == Delay
+		if listener.global != nil && listener.mode == Reject {
+			if !listener.global.IsAllowed(1, now) {
+				conn.Close()
+				continue
+			}
+			globalCharged = true
+		}
+
+		if listener.perIP != nil && !listener.perIP.IsAllowed(sourceIP(conn), 0, 1, now) {
+			// the connection does not count against the global limit if its IP is over the limit
+			if globalCharged {
+				listener.global.ReturnTokens(1)
+			}
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+var _ net.Listener = (*Listener)(nil)
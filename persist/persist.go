@@ -0,0 +1,368 @@
+// Token bucket which survives restarts, for quotas over days or months which can not live in memory only.
+// Every change of the bucket is appended to a journal before the call returns, and the journal is
+// compacted into a snapshot of the bucket from time to time. On startup the snapshot is loaded and
+// the journal is replayed on top of it with the timestamps of the records, so the refill math of the
+// bucket type computes exactly the state the bucket had before.
+//
+// Every record is written to the journal with its own write, so a crash of the process loses nothing.
+// The journal is only fsynced once per SyncInterval though, a crash of the machine loses the records
+// of at most the last SyncInterval. Those tokens are handed out again after the restart, so the worst
+// case over-admission is everything admitted in one SyncInterval, which is bounded by
+// capacity + refillRate * SyncInterval. Calling Sync after critical requests removes it for them.
+//
+// Journal record (32 bytes, big endian): crc32 of the rest uint32 | kind uint32 | sequence number uint64 |
+// Unix timestamp in nanoseconds int64 | amount int64 or refill rate as float64 bits
+// Snapshot: version byte | sequence number of the last record it contains uint64 | bucket snapshot
+
+package persist
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"stepwell/tokenbucket"
+	"sync"
+	"time"
+)
+
+const (
+	recordSize      = 32
+	snapshotVersion = 1
+)
+
+const (
+	recordConsume uint32 = iota + 1
+	recordReturn
+	recordRefillRate
+)
+
+type Config struct {
+	// path of the journal, the snapshot is kept next to it in Path + ".snapshot"
+	Path string
+	// the replay has to come to the same decisions as the original calls, so bucketType must not
+	// depend on anything but the timestamps. The timestamp token bucket is exact even for a few tokens per day.
+	BucketType int
+	Capacity   int64
+	RefillRate float64
+	// the journal is fsynced at most once per SyncInterval
+	SyncInterval time.Duration
+	// after CompactAfter records the bucket is written to the snapshot and the journal starts over
+	CompactAfter int
+	// a Quota above 0 adds a calendar quota which resets at the boundaries of Period in Location,
+	// a RefillRate of 0 leaves only the quota
+	Quota    int64
+	Period   tokenbucket.Period
+	Location *time.Location
+}
+
+type Limiter struct {
+	config  Config
+	bucket  tokenbucket.TokenBucketInterface
+	journal *os.File
+	seq     uint64
+	// records in the journal since the last compaction
+	numRecords int
+	// records written since the last fsync
+	dirty    bool
+	closed   bool
+	stopChan chan struct{}
+	wait     sync.WaitGroup
+	sync.Mutex
+}
+
+// Open recovers the bucket from the snapshot and the journal at config.Path, or creates a full bucket at now
+// if there is none yet. The returned limiter fsyncs the journal in the background until it is closed.
+func Open(config Config, now time.Time) (*Limiter, error) {
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = 100 * time.Millisecond
+	}
+	if config.CompactAfter <= 0 {
+		config.CompactAfter = 100_000
+	}
+
+	limiter := &Limiter{config: config, stopChan: make(chan struct{})}
+	snapshotFound, err := limiter.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if !snapshotFound {
+		limiter.bucket = newBucket(config, now)
+	}
+
+	journal, err := os.OpenFile(config.Path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	limiter.journal = journal
+	if err := limiter.replay(); err != nil {
+		journal.Close()
+		return nil, err
+	}
+	// a new journal starts with a snapshot, otherwise the creation time of the bucket would get lost
+	if !snapshotFound {
+		if err := limiter.compact(); err != nil {
+			journal.Close()
+			return nil, err
+		}
+	}
+
+	limiter.wait.Add(1)
+	go limiter.syncWorker()
+	return limiter, nil
+}
+
+func newBucket(config Config, now time.Time) tokenbucket.TokenBucketInterface {
+	if config.Quota <= 0 {
+		return tokenbucket.NewTokenBucketByType(config.BucketType, config.Capacity, config.RefillRate, now)
+	}
+	quota := tokenbucket.NewTokenBucketCalendar(config.Quota, config.Period, config.Location, now)
+	if config.RefillRate <= 0 {
+		return quota
+	}
+	return tokenbucket.NewTokenBucketComposite(tokenbucket.NewTokenBucketByType(config.BucketType, config.Capacity, config.RefillRate, now), quota)
+}
+
+func (limiter *Limiter) snapshotPath() string {
+	return limiter.config.Path + ".snapshot"
+}
+
+func (limiter *Limiter) loadSnapshot() (bool, error) {
+	data, err := os.ReadFile(limiter.snapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(data) < 9 || data[0] != snapshotVersion {
+		return false, errors.New("invalid snapshot " + limiter.snapshotPath())
+	}
+	bucket, err := tokenbucket.UnmarshalTokenBucket(data[9:])
+	if err != nil {
+		return false, err
+	}
+	limiter.bucket = bucket
+	limiter.seq = binary.BigEndian.Uint64(data[1:])
+	return true, nil
+}
+
+// replay applies all records newer than the snapshot. A record which was only written in parts when the
+// process crashed fails its checksum, the journal is cut off in front of it.
+func (limiter *Limiter) replay() error {
+	data, err := io.ReadAll(limiter.journal)
+	if err != nil {
+		return err
+	}
+	valid := 0
+	for ; valid+recordSize <= len(data); valid += recordSize {
+		record := data[valid : valid+recordSize]
+		if crc32.ChecksumIEEE(record[4:]) != binary.BigEndian.Uint32(record) {
+			break
+		}
+		kind := binary.BigEndian.Uint32(record[4:])
+		seq := binary.BigEndian.Uint64(record[8:])
+		now := time.Unix(0, int64(binary.BigEndian.Uint64(record[16:])))
+		value := binary.BigEndian.Uint64(record[24:])
+		limiter.numRecords++
+		// records written before the last compaction was completed are already part of the snapshot
+		if seq <= limiter.seq {
+			continue
+		}
+		limiter.seq = seq
+		switch kind {
+		case recordConsume:
+			limiter.bucket.IsAllowed(int64(value), now)
+		case recordReturn:
+			tokenbucket.ReturnTokensAt(limiter.bucket, int64(value), now)
+		case recordRefillRate:
+			limiter.bucket.SetRefillRate(math.Float64frombits(value))
+		}
+	}
+	if err := limiter.journal.Truncate(int64(valid)); err != nil {
+		return err
+	}
+	_, err = limiter.journal.Seek(int64(valid), io.SeekStart)
+	return err
+}
+
+// append writes one record, the caller holds the lock
+func (limiter *Limiter) append(kind uint32, now time.Time, value uint64) error {
+	if limiter.closed {
+		return errors.New("persistent limiter is closed")
+	}
+	var record [recordSize]byte
+	binary.BigEndian.PutUint32(record[4:], kind)
+	binary.BigEndian.PutUint64(record[8:], limiter.seq+1)
+	binary.BigEndian.PutUint64(record[16:], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(record[24:], value)
+	binary.BigEndian.PutUint32(record[0:], crc32.ChecksumIEEE(record[4:]))
+	if _, err := limiter.journal.Write(record[:]); err != nil {
+		return err
+	}
+	limiter.seq++
+	limiter.numRecords++
+	limiter.dirty = true
+	if limiter.numRecords >= limiter.config.CompactAfter {
+		return limiter.compact()
+	}
+	return nil
+}
+
+// compact writes the bucket to a new snapshot and empties the journal. The snapshot replaces the old one
+// with a rename, a crash at any point leaves either the old or the new snapshot behind.
+func (limiter *Limiter) compact() error {
+	bucket, err := tokenbucket.MarshalTokenBucket(limiter.bucket)
+	if err != nil {
+		return err
+	}
+	data := []byte{snapshotVersion}
+	data = binary.BigEndian.AppendUint64(data, limiter.seq)
+	data = append(data, bucket...)
+
+	tmpPath := limiter.snapshotPath() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, limiter.snapshotPath()); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(limiter.snapshotPath())); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	if err := limiter.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := limiter.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	limiter.numRecords = 0
+	limiter.dirty = false
+	return limiter.journal.Sync()
+}
+
+// IsAllowed only admits requests whose record made it into the journal, if the write fails the tokens go back
+func (limiter *Limiter) IsAllowed(amount int64, now time.Time) bool {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if !limiter.bucket.IsAllowed(amount, now) {
+		return false
+	}
+	if amount == 0 {
+		return true
+	}
+	if err := limiter.append(recordConsume, now, uint64(amount)); err != nil {
+		tokenbucket.ReturnTokensAt(limiter.bucket, amount, now)
+		return false
+	}
+	return true
+}
+
+func (limiter *Limiter) AllowUpTo(max int64, now time.Time) int64 {
+	limiter.Lock()
+	defer limiter.Unlock()
+	granted := limiter.bucket.AllowUpTo(max, now)
+	if granted <= 0 {
+		return granted
+	}
+	if err := limiter.append(recordConsume, now, uint64(granted)); err != nil {
+		tokenbucket.ReturnTokensAt(limiter.bucket, granted, now)
+		return 0
+	}
+	return granted
+}
+
+func (limiter *Limiter) ReturnTokens(amount int64) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	// the replay gives the tokens back with the time of the record, so this call does the same
+	now := time.Now()
+	if limiter.append(recordReturn, now, uint64(amount)) == nil {
+		tokenbucket.ReturnTokensAt(limiter.bucket, amount, now)
+	}
+}
+
+func (limiter *Limiter) SetRefillRate(refillRate float64) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.append(recordRefillRate, time.Now(), math.Float64bits(refillRate)) == nil {
+		limiter.bucket.SetRefillRate(refillRate)
+	}
+}
+
+func (limiter *Limiter) GetCapacity() int64 {
+	return limiter.bucket.GetCapacity()
+}
+
+func (limiter *Limiter) GetTokens() int64 {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.bucket.GetTokens()
+}
+
+// Sync fsyncs the journal right away
+func (limiter *Limiter) Sync() error {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.sync()
+}
+
+func (limiter *Limiter) sync() error {
+	if !limiter.dirty || limiter.closed {
+		return nil
+	}
+	limiter.dirty = false
+	return limiter.journal.Sync()
+}
+
+func (limiter *Limiter) syncWorker() {
+	defer limiter.wait.Done()
+	ticker := time.NewTicker(limiter.config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-limiter.stopChan:
+			return
+		case <-ticker.C:
+			limiter.Sync()
+		}
+	}
+}
+
+// Close compacts the journal, so the next start only has to load the snapshot
+func (limiter *Limiter) Close() error {
+	limiter.Lock()
+	if limiter.closed {
+		limiter.Unlock()
+		return errors.New("persistent limiter is already closed")
+	}
+	close(limiter.stopChan)
+	err := limiter.compact()
+	limiter.closed = true
+	if closeErr := limiter.journal.Close(); err == nil {
+		err = closeErr
+	}
+	limiter.Unlock()
+
+	limiter.wait.Wait()
+	return err
+}
+
+var _ tokenbucket.TokenBucketInterface = (*Limiter)(nil)
@@ -0,0 +1,217 @@
+package prefix
+
+import (
+	"errors"
+	"net/netip"
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PrefixLimiterInterface interface {
+	IsAllowed(addr netip.Addr, amount int64, now time.Time) bool
+}
+
+// Level is one prefix length which gets its own bucket per prefix, e.g. every /24
+type Level struct {
+	PrefixLen  int
+	Capacity   int64
+	RefillRate float64
+}
+
+type Config struct {
+	BucketType int
+	// bucket shared by all addresses of both families
+	Global Level
+	// ordered from the shortest to the longest prefix, e.g. /16, /24, /32
+	V4Levels []Level
+	V6Levels []Level
+	// prefixes which did not see traffic for IdleTimeout are removed by Evict, 0 keeps them forever
+	IdleTimeout time.Duration
+	// how often the worker calls Evict
+	EvictDelay time.Duration
+}
+
+// The trie only has a level for every configured prefix length, all bits in between are skipped.
+// Every trie node owns a StepWellNode whose parent is the node of the next shorter prefix,
+// so charging an address is the same leaf-to-root walk as in StepWell.
+type trieNode struct {
+	node *stepwell.StepWellNode
+	// netip.Prefix -> *trieNode, lookups of existing prefixes never take a lock
+	children sync.Map
+	// Store as Unix timestamp to be able to use atomic operations
+	lastSeen int64
+}
+
+// lastSeen is only written when it is at least this much out of date
+const lastSeenResolution = int64(time.Millisecond)
+
+type PrefixLimiter struct {
+	config Config
+	global *stepwell.StepWellNode
+	// virtual roots without a bucket of their own, their children point to the global node
+	v4            *trieNode
+	v6            *trieNode
+	workerRunning bool
+	stopChan      chan struct{}
+	// only Evict takes the lock, so two evictions do not walk the trie at the same time
+	sync.Mutex
+}
+
+// validateLevels checks that the prefix lengths fit the address family and grow from level to level
+func validateLevels(levels []Level, bits int, family string) error {
+	previous := -1
+	for _, level := range levels {
+		if level.PrefixLen < 0 || level.PrefixLen > bits {
+			return errors.New(family + " prefix length " + strconv.Itoa(level.PrefixLen) + " is out of range 0 to " + strconv.Itoa(bits))
+		}
+		if level.PrefixLen <= previous {
+			return errors.New(family + " prefix lengths have to be ascending, " + strconv.Itoa(level.PrefixLen) + " follows " + strconv.Itoa(previous))
+		}
+		previous = level.PrefixLen
+	}
+	return nil
+}
+
+func NewPrefixLimiter(config Config, now time.Time) (*PrefixLimiter, error) {
+	if err := validateLevels(config.V4Levels, 32, "IPv4"); err != nil {
+		return nil, err
+	}
+	if err := validateLevels(config.V6Levels, 128, "IPv6"); err != nil {
+		return nil, err
+	}
+	if config.EvictDelay <= 0 {
+		config.EvictDelay = time.Second
+	}
+	global := &stepwell.StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(config.BucketType, config.Global.Capacity, config.Global.RefillRate, now)}
+	return &PrefixLimiter{
+		config:   config,
+		global:   global,
+		v4:       &trieNode{node: global},
+		v6:       &trieNode{node: global},
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+func (limiter *PrefixLimiter) rootAndLevels(addr netip.Addr) (*trieNode, []Level) {
+	if addr.Is4() {
+		return limiter.v4, limiter.config.V4Levels
+	}
+	return limiter.v6, limiter.config.V6Levels
+}
+
+func touch(trie *trieNode, nowUnix int64) {
+	if nowUnix-atomic.LoadInt64(&trie.lastSeen) > lastSeenResolution {
+		atomic.StoreInt64(&trie.lastSeen, nowUnix)
+	}
+}
+
+// lookup returns the StepWellNode of the longest configured prefix of addr and creates missing prefixes on the way
+func (limiter *PrefixLimiter) lookup(addr netip.Addr, now time.Time) *stepwell.StepWellNode {
+	addr = addr.Unmap()
+	curr, levels := limiter.rootAndLevels(addr)
+	nowUnix := now.UnixNano()
+
+	for _, level := range levels {
+		// NewPrefixLimiter made sure that the prefix length fits the address family
+		prefix, _ := addr.Prefix(level.PrefixLen)
+		value, ok := curr.children.Load(prefix)
+		if !ok {
+			// concurrent lookups of a new prefix agree on one node, the others drop theirs
+			value, _ = curr.children.LoadOrStore(prefix, &trieNode{
+				node: &stepwell.StepWellNode{
+					TokenBucket: tokenbucket.NewTokenBucketByType(limiter.config.BucketType, level.Capacity, level.RefillRate, now),
+					Parent:      curr.node,
+				},
+				lastSeen: nowUnix,
+			})
+		}
+		child := value.(*trieNode)
+		touch(child, nowUnix)
+		curr = child
+	}
+	return curr.node
+}
+
+// IsAllowed charges the buckets of all configured prefixes of addr and the global bucket
+func (limiter *PrefixLimiter) IsAllowed(addr netip.Addr, amount int64, now time.Time) bool {
+	return limiter.lookup(addr, now).IsAllowed(amount, now)
+}
+
+func (limiter *PrefixLimiter) AllowUpTo(addr netip.Addr, max int64, now time.Time) int64 {
+	return limiter.lookup(addr, now).AllowUpTo(max, now)
+}
+
+// Evict removes every prefix which was idle for longer than the IdleTimeout and has no more children.
+// A prefix starts again with a full bucket when it shows up after being evicted.
+func (limiter *PrefixLimiter) Evict(now time.Time) {
+	if limiter.config.IdleTimeout <= 0 {
+		return
+	}
+	deadline := now.UnixNano() - int64(limiter.config.IdleTimeout)
+
+	limiter.Lock()
+	defer limiter.Unlock()
+	evictChildren(limiter.v4, deadline)
+	evictChildren(limiter.v6, deadline)
+}
+
+// evictChildren removes the idle leaves of the trie. A lookup which walked into a prefix right before it was
+// removed charges a node which is no longer in the trie, the next lookup creates the prefix again.
+func evictChildren(trie *trieNode, deadline int64) {
+	trie.children.Range(func(prefix, value any) bool {
+		child := value.(*trieNode)
+		evictChildren(child, deadline)
+		if !hasChildren(child) && atomic.LoadInt64(&child.lastSeen) < deadline {
+			trie.children.CompareAndDelete(prefix, child)
+		}
+		return true
+	})
+}
+
+func hasChildren(trie *trieNode) bool {
+	found := false
+	trie.children.Range(func(prefix, value any) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+func (limiter *PrefixLimiter) StartWorker() {
+	if limiter.workerRunning {
+		return
+	}
+	limiter.workerRunning = true
+	limiter.stopChan = make(chan struct{})
+
+	go limiter.startWorkerCore()
+}
+
+func (limiter *PrefixLimiter) StopWorker() {
+	if !limiter.workerRunning {
+		return
+	}
+	limiter.workerRunning = false
+
+	close(limiter.stopChan)
+}
+
+func (limiter *PrefixLimiter) startWorkerCore() {
+	ticker := time.NewTicker(limiter.config.EvictDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-limiter.stopChan:
+			return
+		case now := <-ticker.C:
+			limiter.Evict(now)
+		}
+	}
+}
+
+var _ PrefixLimiterInterface = (*PrefixLimiter)(nil)
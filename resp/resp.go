@@ -0,0 +1,298 @@
+// Redis protocol server with the CL.THROTTLE command of redis-cell: https://github.com/brandur/redis-cell
+// Clients which already use redis-cell can switch over without code changes.
+
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"stepwell/tokenbucket"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CL.THROTTLE takes at most 6 arguments, the caps keep a client from making the server allocate arbitrary memory
+	maxArgs       = 64
+	maxBulkLength = 64 * 1024
+	// inline commands and the * and $ headers have to fit into the buffer of the reader
+	maxLineLength = 64 * 1024
+)
+
+// the parameters a key was created with, a key is created again if a client changes them
+type cellParams struct {
+	maxBurst int64
+	count    int64
+	period   int64
+}
+
+type cell struct {
+	params cellParams
+	bucket *tokenbucket.TokenBucketHelia
+}
+
+type Server struct {
+	cells sync.Map
+	// how often keys whose bucket is full again are dropped
+	sweepDelay    time.Duration
+	workerRunning bool
+	stopChan      chan struct{}
+}
+
+func NewServer() *Server {
+	return &Server{
+		sweepDelay: time.Minute,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Throttle implements CL.THROTTLE key max_burst count period quantity and returns
+// limited (0/1), limit, remaining, retry after and reset after in seconds
+func (server *Server) Throttle(key string, maxBurst int64, count int64, period int64, quantity int64, now time.Time) [5]int64 {
+	params := cellParams{maxBurst: maxBurst, count: count, period: period}
+	// GCRA: the bucket holds max_burst+1 tokens and refills count tokens per period
+	capacity := maxBurst + 1
+	refillRate := float64(count) / float64(period)
+
+	// concurrent first requests of a key have to end up with the same cell, otherwise one of them loses its charge
+	var bucket *tokenbucket.TokenBucketHelia
+	for bucket == nil {
+		value, ok := server.cells.Load(key)
+		if !ok {
+			newCell := &cell{params: params, bucket: tokenbucket.NewTokenBucketHelia(capacity, refillRate, now)}
+			value, _ = server.cells.LoadOrStore(key, newCell)
+		}
+		if value.(*cell).params == params {
+			bucket = value.(*cell).bucket
+			continue
+		}
+		// like redis-cell the new parameters apply to the TAT of the key, otherwise switching between
+		// two parameter sets would hand out a full bucket every time
+		timestamp := value.(*cell).bucket.GetTimestamp()
+		if timestamp.Before(now) {
+			timestamp = now
+		}
+		newCell := &cell{params: params, bucket: tokenbucket.NewTokenBucketHelia(capacity, refillRate, timestamp)}
+		if server.cells.CompareAndSwap(key, value, newCell) {
+			bucket = newCell.bucket
+		}
+	}
+
+	limited := int64(0)
+	if !bucket.IsAllowed(quantity, now) {
+		limited = 1
+	}
+	remaining := bucket.GetTokensAt(now)
+
+	retryAfter := int64(-1)
+	if limited == 1 {
+		retryAfter = int64(math.Ceil(float64(quantity-remaining) / refillRate))
+	}
+	resetAfter := int64(math.Ceil(float64(capacity-remaining) / refillRate))
+	return [5]int64{limited, capacity, remaining, retryAfter, resetAfter}
+}
+
+// Sweep drops the keys whose bucket is full, they would be created with the same state on their next use
+func (server *Server) Sweep() {
+	server.cells.Range(func(key, value any) bool {
+		c := value.(*cell)
+		if c.bucket.GetTokens() >= c.bucket.GetCapacity() {
+			server.cells.CompareAndDelete(key, c)
+		}
+		return true
+	})
+}
+
+func (server *Server) StartWorker() {
+	if server.workerRunning {
+		return
+	}
+	server.workerRunning = true
+	server.stopChan = make(chan struct{})
+
+	go server.startWorkerCore()
+}
+
+func (server *Server) StopWorker() {
+	if !server.workerRunning {
+		return
+	}
+	server.workerRunning = false
+
+	close(server.stopChan)
+}
+
+func (server *Server) startWorkerCore() {
+	ticker := time.NewTicker(server.sweepDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.stopChan:
+			return
+		case <-ticker.C:
+			server.Sweep()
+		}
+	}
+}
+
+func ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := NewServer()
+	server.StartWorker()
+	defer server.StopWorker()
+	return server.Serve(listener)
+}
+
+func (server *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.handleConn(conn)
+	}
+}
+
+func (server *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, maxLineLength)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				writeError(writer, err.Error())
+				writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := server.execute(args, writer)
+		// pipelined commands are answered together once no more input is buffered
+		if reader.Buffered() == 0 || quit {
+			if err := writer.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+func (server *Server) execute(args []string, writer *bufio.Writer) bool {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if len(args) > 1 {
+			writeBulk(writer, args[1])
+		} else {
+			writer.WriteString("+PONG\r\n")
+		}
+	case "QUIT":
+		writer.WriteString("+OK\r\n")
+		return true
+	case "COMMAND":
+		// redis-cli asks for the command table on startup
+		writer.WriteString("*0\r\n")
+	case "CL.THROTTLE":
+		server.executeThrottle(args, writer)
+	default:
+		writeError(writer, "unknown command '"+args[0]+"'")
+	}
+	return false
+}
+
+func (server *Server) executeThrottle(args []string, writer *bufio.Writer) {
+	if len(args) != 5 && len(args) != 6 {
+		writeError(writer, "wrong number of arguments for 'cl.throttle' command")
+		return
+	}
+	values := []int64{0, 0, 0, 1}
+	for i := range values {
+		if i == 3 && len(args) == 5 {
+			break
+		}
+		value, err := strconv.ParseInt(args[i+2], 10, 64)
+		if err != nil || value < 0 {
+			writeError(writer, "invalid argument "+args[i+2])
+			return
+		}
+		values[i] = value
+	}
+	if values[1] <= 0 || values[2] <= 0 {
+		writeError(writer, "count and period must be positive")
+		return
+	}
+
+	result := server.Throttle(args[1], values[0], values[1], values[2], values[3], time.Now())
+	writer.WriteString("*5\r\n")
+	for _, value := range result {
+		writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+	}
+}
+
+func writeError(writer *bufio.Writer, message string) {
+	writer.WriteString("-ERR " + message + "\r\n")
+}
+
+func writeBulk(writer *bufio.Writer, value string) {
+	writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+// readLine never reads more than the buffer of reader holds, a line without newline is an error instead of a growing string
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readCommand reads either a RESP array of bulk strings or an inline command as sent by telnet
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > maxArgs {
+		return nil, errors.New("invalid multibulk length")
+	}
+	args := make([]string, count)
+	for i := range args {
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, errors.New("expected '$', got '" + header + "'")
+		}
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, errors.New("invalid bulk length")
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
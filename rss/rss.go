@@ -0,0 +1,124 @@
+// Receive side scaling in software: https://learn.microsoft.com/en-us/windows-hardware/drivers/network/rss-hashing-functions
+// With the same key and indirection table as the NIC, a flow lands on the StepWell port of the core whose queue receives it.
+
+package rss
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"stepwell/stepwell"
+	"strconv"
+	"time"
+)
+
+// the well known default key of the Microsoft RSS specification which most NICs ship with
+var DefaultKey = []byte{
+	0x6d, 0x5a, 0x56, 0xda, 0x25, 0x5b, 0x0e, 0xc2,
+	0x41, 0x67, 0x25, 0x3d, 0x43, 0xa3, 0x8f, 0xb0,
+	0xd0, 0xca, 0x2b, 0xcb, 0xae, 0x7b, 0x30, 0xb4,
+	0x77, 0xcb, 0x2d, 0xa3, 0x80, 0x30, 0xf2, 0x0c,
+	0x6a, 0x42, 0xb7, 0x3b, 0xbe, 0xac, 0x01, 0xfa,
+}
+
+// size of the indirection table of most NICs
+const DefaultTableSize = 128
+
+// the longest hash input is an IPv6 4-tuple: 16 + 16 + 2 + 2 bytes, the key needs 4 more bytes than the input
+const minKeyLen = 40
+
+const (
+	ProtocolTCP = 6
+	ProtocolUDP = 17
+)
+
+type FiveTuple struct {
+	SrcIP    netip.Addr
+	DstIP    netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+type Classifier struct {
+	key []byte
+	// maps the low bits of the hash to a StepWell port
+	table []uint64
+}
+
+// NewClassifier uses the default key and spreads the indirection table round robin over numPorts, like the NIC drivers do
+func NewClassifier(numPorts uint64) *Classifier {
+	if numPorts <= 0 {
+		return nil
+	}
+	table := make([]uint64, DefaultTableSize)
+	for i := range table {
+		table[i] = uint64(i) % numPorts
+	}
+	classifier, _ := NewClassifierWithKey(DefaultKey, table, numPorts)
+	return classifier
+}
+
+// numPorts is the number of ports of the StepWell the classifier feeds, len(Cores) of a StepWell.
+// A table entry outside of it would select a port which does not exist.
+func NewClassifierWithKey(key []byte, table []uint64, numPorts uint64) (*Classifier, error) {
+	if len(key) < minKeyLen {
+		return nil, errors.New("RSS key must be at least 40 bytes long")
+	}
+	if len(table) == 0 {
+		return nil, errors.New("indirection table must not be empty")
+	}
+	for i, port := range table {
+		if port >= numPorts {
+			return nil, errors.New("indirection table entry " + strconv.Itoa(i) + " selects port " +
+				strconv.FormatUint(port, 10) + " of only " + strconv.FormatUint(numPorts, 10) + " ports")
+		}
+	}
+	return &Classifier{
+		key:   append([]byte(nil), key...),
+		table: append([]uint64(nil), table...),
+	}, nil
+}
+
+func toeplitz(key []byte, input []byte) uint32 {
+	result := uint32(0)
+	// the 32 bit window of the key which slides one bit per input bit
+	window := binary.BigEndian.Uint32(key)
+	for i, b := range input {
+		for bit := 7; bit >= 0; bit-- {
+			if b&(1<<bit) != 0 {
+				result ^= window
+			}
+			window <<= 1
+			if key[i+4]&(1<<bit) != 0 {
+				window |= 1
+			}
+		}
+	}
+	return result
+}
+
+// Hash computes the Toeplitz hash over source and destination address and, for TCP and UDP, the ports.
+// Other protocols are hashed over the addresses only, like the 2-tuple hash types of the NICs.
+func (classifier *Classifier) Hash(tuple FiveTuple) uint32 {
+	var buffer [36]byte
+	input := buffer[:0]
+	src := tuple.SrcIP.Unmap()
+	dst := tuple.DstIP.Unmap()
+	input = append(input, src.AsSlice()...)
+	input = append(input, dst.AsSlice()...)
+	if tuple.Protocol == ProtocolTCP || tuple.Protocol == ProtocolUDP {
+		input = binary.BigEndian.AppendUint16(input, tuple.SrcPort)
+		input = binary.BigEndian.AppendUint16(input, tuple.DstPort)
+	}
+	return toeplitz(classifier.key, input)
+}
+
+// Port selects the StepWell port of a flow, all packets of a flow always get the same port
+func (classifier *Classifier) Port(tuple FiveTuple) uint64 {
+	return classifier.table[classifier.Hash(tuple)%uint32(len(classifier.table))]
+}
+
+func (classifier *Classifier) IsAllowed(limiter stepwell.StepWellInterface, tuple FiveTuple, amount int64, now time.Time) bool {
+	return limiter.IsAllowed(classifier.Port(tuple), amount, now)
+}
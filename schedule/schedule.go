@@ -0,0 +1,303 @@
+// Time-of-day schedules for the refill rate and the capacity, e.g. higher limits at night and lower ones
+// during business hours. A scheduler goroutine applies the schedule to buckets, StepWells and StepWellPluses.
+//
+// Example config:
+//
+//	{"location": "Europe/Zurich", "transition": "smooth", "points": [
+//		{"at": "08:00", "refillRate": 100, "capacity": 200},
+//		{"at": "18:00", "refillRate": 1000, "capacity": 2000}]}
+
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"stepwell/tokenbucket"
+	"sync"
+	"time"
+)
+
+type Point struct {
+	// time of day in the location of the schedule, "15:04" or "15:04:05"
+	At         string  `json:"at"`
+	RefillRate float64 `json:"refillRate"`
+	// 0 keeps the capacity the targets have
+	Capacity int64 `json:"capacity"`
+}
+
+type Config struct {
+	// IANA time zone name, empty means UTC
+	Location string `json:"location"`
+	// "step" keeps the values of a point until the next point, "smooth" moves linearly towards the next point
+	Transition string  `json:"transition"`
+	Points     []Point `json:"points"`
+	// how often the scheduler applies the schedule, 0 means once per minute
+	IntervalSeconds int `json:"intervalSeconds"`
+}
+
+type point struct {
+	// time since midnight on the wall clock
+	offset     time.Duration
+	refillRate float64
+	capacity   int64
+}
+
+type Schedule struct {
+	location *time.Location
+	smooth   bool
+	points   []point
+	interval time.Duration
+}
+
+func LoadConfig(file string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+func NewSchedule(config Config) (*Schedule, error) {
+	if len(config.Points) == 0 {
+		return nil, errors.New("schedule needs at least one point")
+	}
+	location, err := time.LoadLocation(config.Location)
+	if err != nil {
+		return nil, err
+	}
+	schedule := &Schedule{location: location, interval: time.Minute}
+	switch config.Transition {
+	case "", "step":
+	case "smooth":
+		schedule.smooth = true
+	default:
+		return nil, errors.New("unknown transition " + config.Transition)
+	}
+	if config.IntervalSeconds > 0 {
+		schedule.interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+
+	for _, configPoint := range config.Points {
+		at, err := time.Parse("15:04:05", configPoint.At)
+		if err != nil {
+			if at, err = time.Parse("15:04", configPoint.At); err != nil {
+				return nil, errors.New("invalid time of day " + configPoint.At)
+			}
+		}
+		offset := time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute + time.Duration(at.Second())*time.Second
+		schedule.points = append(schedule.points, point{offset: offset, refillRate: configPoint.RefillRate, capacity: configPoint.Capacity})
+	}
+	sort.Slice(schedule.points, func(i, j int) bool {
+		return schedule.points[i].offset < schedule.points[j].offset
+	})
+	return schedule, nil
+}
+
+// At returns the refill rate and the capacity the schedule sets at now. The time of day is read from the wall
+// clock, so on a day with a DST change a point at 08:00 still applies at 08:00.
+func (schedule *Schedule) At(now time.Time) (float64, int64) {
+	local := now.In(schedule.location)
+	offset := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute +
+		time.Duration(local.Second())*time.Second + time.Duration(local.Nanosecond())
+
+	// the point in effect is the last one before offset, before the first point of the day it is the last one of yesterday
+	numPoints := len(schedule.points)
+	current := numPoints - 1
+	for i, point := range schedule.points {
+		if point.offset <= offset {
+			current = i
+		}
+	}
+	from := schedule.points[current]
+	if !schedule.smooth || numPoints == 1 {
+		return from.refillRate, from.capacity
+	}
+
+	to := schedule.points[(current+1)%numPoints]
+	span := to.offset - from.offset
+	elapsed := offset - from.offset
+	if span <= 0 {
+		span += 24 * time.Hour
+	}
+	if elapsed < 0 {
+		elapsed += 24 * time.Hour
+	}
+	fraction := float64(elapsed) / float64(span)
+	refillRate := from.refillRate + fraction*(to.refillRate-from.refillRate)
+	capacity := from.capacity
+	if from.capacity > 0 && to.capacity > 0 {
+		capacity = from.capacity + int64(fraction*float64(to.capacity-from.capacity))
+	}
+	return refillRate, capacity
+}
+
+// Clock lets tests run a scheduler on a FakeClock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var RealClock Clock = realClock{}
+
+type waiter struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+// FakeClock only moves when Advance is called
+type FakeClock struct {
+	now     time.Time
+	waiters []waiter
+	sync.Mutex
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	channel := make(chan time.Time, 1)
+	if d <= 0 {
+		channel <- clock.now
+		return channel
+	}
+	clock.waiters = append(clock.waiters, waiter{deadline: clock.now.Add(d), channel: channel})
+	return channel
+}
+
+// Advance moves the clock forward and fires all channels of After whose time has come
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(d)
+	waiting := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.deadline.After(clock.now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.channel <- clock.now
+		}
+	}
+	clock.waiters = waiting
+}
+
+// Target is anything with a refill rate, which includes all buckets, StepWell and StepWellPlus.
+// Targets which also implement tokenbucket.CapacitySetter follow the capacity of the schedule.
+type Target interface {
+	SetRefillRate(refillRate float64)
+}
+
+type Scheduler struct {
+	schedule *Schedule
+	clock    Clock
+	targets  []Target
+	// values applied last, the targets are only touched when they change
+	refillRate float64
+	capacity   int64
+	applied    bool
+	running    bool
+	stopChan   chan struct{}
+	wait       sync.WaitGroup
+	sync.Mutex
+}
+
+func NewScheduler(schedule *Schedule, clock Clock, targets ...Target) *Scheduler {
+	if clock == nil {
+		clock = RealClock
+	}
+	return &Scheduler{schedule: schedule, clock: clock, targets: targets, stopChan: make(chan struct{})}
+}
+
+// Apply sets the values of the schedule at the current time of the clock on all targets
+func (scheduler *Scheduler) Apply() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	refillRate, capacity := scheduler.schedule.At(scheduler.clock.Now())
+	if scheduler.applied && refillRate == scheduler.refillRate && capacity == scheduler.capacity {
+		return
+	}
+	for _, target := range scheduler.targets {
+		target.SetRefillRate(refillRate)
+		if setter, ok := target.(tokenbucket.CapacitySetter); ok && capacity > 0 {
+			setter.SetCapacity(capacity)
+		}
+	}
+	scheduler.refillRate = refillRate
+	scheduler.capacity = capacity
+	scheduler.applied = true
+}
+
+func (scheduler *Scheduler) GetRefillRate() float64 {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.refillRate
+}
+
+func (scheduler *Scheduler) GetCapacity() int64 {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	return scheduler.capacity
+}
+
+// Start applies the schedule right away and then once per interval
+func (scheduler *Scheduler) Start() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if scheduler.running {
+		return
+	}
+	scheduler.running = true
+	scheduler.stopChan = make(chan struct{})
+
+	scheduler.wait.Add(1)
+	go scheduler.run(scheduler.stopChan)
+}
+
+func (scheduler *Scheduler) Stop() {
+	scheduler.Lock()
+	if !scheduler.running {
+		scheduler.Unlock()
+		return
+	}
+	scheduler.running = false
+	close(scheduler.stopChan)
+	scheduler.Unlock()
+	scheduler.wait.Wait()
+}
+
+func (scheduler *Scheduler) run(stopChan chan struct{}) {
+	defer scheduler.wait.Done()
+	for {
+		// the next tick is registered before the targets are touched, so a clock which is advanced right
+		// after the values of this tick are visible cannot skip it
+		tick := scheduler.clock.After(scheduler.schedule.interval)
+		scheduler.Apply()
+		select {
+		case <-stopChan:
+			return
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Limiter daemon which lets several processes on one host share their quotas over HTTP/JSON
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"stepwell/extensions"
+	"stepwell/keyed"
+	"time"
+)
+
+// Limit applies to every key matching Pattern (path.Match syntax, e.g. "api:*")
+type Limit struct {
+	Pattern string `json:"pattern"`
+	// one of the thread safe bucket types 2 to 6, 0 uses DefaultBucketType
+	BucketType int     `json:"bucketType"`
+	Capacity   int64   `json:"capacity"`
+	RefillRate float64 `json:"refillRate"`
+	// keys which were not used for TTLSeconds are dropped, 0 keeps them
+	TTLSeconds int `json:"ttlSeconds"`
+	// at most MaxKeys keys of this pattern are tracked, 0 means unlimited
+	MaxKeys int `json:"maxKeys"`
+}
+
+type Config struct {
+	// leaves of the StepWell of every key, 0 uses one leaf per CPU
+	NumCores uint64  `json:"numCores"`
+	Limits   []Limit `json:"limits"`
+}
+
+// DefaultBucketType is the lock based bucket, the trivial bucket type 1 is not safe for the concurrent requests of the daemon
+const DefaultBucketType = 3
+
+// a request is a key and an amount, anything larger is not a request
+const maxRequestSize = 64 * 1024
+
+type Request struct {
+	Key    string `json:"key"`
+	Amount int64  `json:"amount"`
+}
+
+type Response struct {
+	Allowed   bool  `json:"allowed"`
+	Remaining int64 `json:"remaining"`
+	// seconds until the request would be allowed, 0 if it was allowed and -1 if it never will be
+	RetryAfter float64 `json:"retryAfter"`
+}
+
+type pattern struct {
+	limit   Limit
+	limiter *keyed.KeyedLimiter
+}
+
+// Server handles requests on many goroutines at once. Every key is a StepWell and every request is
+// charged to the leaf of its extensions.ShardHint, so the daemon scales over its cores like StepWell does.
+type Server struct {
+	patterns []*pattern
+	numCores uint64
+}
+
+func LoadConfig(file string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+func NewServer(config Config) (*Server, error) {
+	if config.NumCores == 0 {
+		config.NumCores = uint64(runtime.NumCPU())
+	}
+	server := &Server{numCores: config.NumCores}
+	for _, limit := range config.Limits {
+		if _, err := path.Match(limit.Pattern, ""); err != nil {
+			return nil, errors.New("invalid pattern " + limit.Pattern)
+		}
+		if limit.BucketType == 0 {
+			limit.BucketType = DefaultBucketType
+		}
+		if limit.BucketType < 2 || limit.BucketType > 6 {
+			return nil, errors.New("bucket type of pattern " + limit.Pattern + " is not one of the thread safe bucket types 2 to 6")
+		}
+		limiter := keyed.NewKeyedLimiter(keyed.Config{
+			BucketType: limit.BucketType,
+			Capacity:   limit.Capacity,
+			RefillRate: limit.RefillRate,
+			NumCores:   config.NumCores,
+			IsHot:      func(key string) bool { return true },
+			TTL:        time.Duration(limit.TTLSeconds) * time.Second,
+			MaxKeys:    limit.MaxKeys,
+		})
+		limiter.StartWorker()
+		server.patterns = append(server.patterns, &pattern{limit: limit, limiter: limiter})
+	}
+	return server, nil
+}
+
+// the first pattern matching the key wins
+func (server *Server) match(key string) *pattern {
+	for _, p := range server.patterns {
+		if matched, _ := path.Match(p.limit.Pattern, key); matched {
+			return p
+		}
+	}
+	return nil
+}
+
+func (server *Server) Allow(request Request, now time.Time) (Response, error) {
+	p := server.match(request.Key)
+	if p == nil {
+		return Response{}, errors.New("no limit configured for key " + request.Key)
+	}
+	if request.Amount <= 0 {
+		request.Amount = 1
+	}
+
+	port := uint64(extensions.ShardHint()) % server.numCores
+	allowed := p.limiter.IsAllowed(request.Key, port, request.Amount, now)
+	response := Response{
+		Allowed:   allowed,
+		Remaining: p.limiter.GetTokens(request.Key, port, now),
+	}
+	if !allowed {
+		// a request larger than the capacity never fits into the bucket, no matter how long the client waits
+		if p.limit.RefillRate > 0 && request.Amount <= p.limit.Capacity {
+			response.RetryAfter = math.Max(float64(request.Amount-response.Remaining), 1) / p.limit.RefillRate
+		} else {
+			response.RetryAfter = -1
+		}
+	}
+	return response, nil
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var request Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := server.Allow(request, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (server *Server) Close() {
+	for _, p := range server.patterns {
+		p.limiter.StopWorker()
+	}
+}
+
+// ListenAndServe answers POST requests of the form {"key": "...", "amount": 1} on /allow
+func ListenAndServe(addr string, config Config) error {
+	server, err := NewServer(config)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/allow", server)
+	return http.ListenAndServe(addr, mux)
+}
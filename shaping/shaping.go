@@ -0,0 +1,265 @@
+// Bandwidth shaping for byte streams, every byte costs one token
+
+package shaping
+
+import (
+	"errors"
+	"io"
+	"net"
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"sync"
+	"time"
+)
+
+// Allower hands out up to max tokens at once. Token buckets fit as they are, a StepWell through StepWellPort.
+type Allower interface {
+	AllowUpTo(max int64, now time.Time) int64
+}
+
+// StepWellPort charges a single port of a StepWell
+type StepWellPort struct {
+	StepWell stepwell.StepWellInterface
+	Port     uint64
+}
+
+func (port *StepWellPort) AllowUpTo(max int64, now time.Time) int64 {
+	return port.StepWell.AllowUpTo(port.Port, max, now)
+}
+
+func (port *StepWellPort) AllowBetween(min int64, max int64, now time.Time) int64 {
+	return port.StepWell.AllowBetween(port.Port, min, max, now)
+}
+
+// betweenAllower grants at least min tokens or none, StepWell nodes and ports do.
+// Token buckets get the same with tokenbucket.AllowBetween.
+type betweenAllower interface {
+	AllowBetween(min int64, max int64, now time.Time) int64
+}
+
+// ErrMinChunkSize is returned by a Reader or Writer with a MinChunkSize whose Allower can not grant a minimum
+var ErrMinChunkSize = errors.New("limiter can not grant a minimum chunk size")
+
+// allowBetween finds the way limiter grants at least min tokens, nil if it can not
+func allowBetween(limiter Allower) func(min int64, max int64, now time.Time) int64 {
+	switch limiter := limiter.(type) {
+	case betweenAllower:
+		return limiter.AllowBetween
+	case tokenbucket.TokenBucketInterface:
+		return func(min int64, max int64, now time.Time) int64 {
+			return tokenbucket.AllowBetween(limiter, min, max, now)
+		}
+	default:
+		return nil
+	}
+}
+
+// DefaultChunkSize limits how many bytes are moved with one read or write. Buffers larger than the
+// capacity of the bucket would otherwise never be allowed.
+const DefaultChunkSize = 32 * 1024
+
+// DefaultGroupMinChunkSize is the smallest grant a connection of a Group waits for, so it does not send
+// one byte whenever the aggregate has a few tokens left
+const DefaultGroupMinChunkSize = 1024
+
+// an empty bucket is polled again after a delay which doubles up to maxWait
+const (
+	minWait = 100 * time.Microsecond
+	maxWait = 10 * time.Millisecond
+)
+
+// acquire blocks until it got at least min (or max if it is smaller) and at most max tokens.
+// It fails with ErrMinChunkSize if min is above 1 and limiter can not grant a minimum.
+func acquire(limiter Allower, min int64, max int64) (int64, error) {
+	if min > max {
+		min = max
+	}
+	between := allowBetween(limiter)
+	if min > 1 && between == nil {
+		return 0, ErrMinChunkSize
+	}
+	wait := minWait
+	for {
+		var granted int64
+		if min > 1 {
+			granted = between(min, max, time.Now())
+		} else {
+			granted = limiter.AllowUpTo(max, time.Now())
+		}
+		if granted > 0 {
+			return granted, nil
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+	}
+}
+
+// pay blocks until all amount tokens are charged
+func pay(limiter Allower, minChunkSize int, amount int64) error {
+	for amount > 0 {
+		granted, err := acquire(limiter, int64(minChunkSize), amount)
+		if err != nil {
+			return err
+		}
+		amount -= granted
+	}
+	return nil
+}
+
+// chunk caps size at chunkSize, a ChunkSize which is not positive means DefaultChunkSize
+func chunk(size int, chunkSize int) int {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if size > chunkSize {
+		return chunkSize
+	}
+	return size
+}
+
+// Reader reads first and pays for the bytes it got afterwards, so short reads never waste tokens
+type Reader struct {
+	reader    io.Reader
+	limiter   Allower
+	ChunkSize int
+	// smallest grant worth waking up for, it must not exceed the capacity of any bucket on the path.
+	// The limiter has to be a token bucket or grant a minimum itself, otherwise ErrMinChunkSize is returned.
+	MinChunkSize int
+}
+
+func NewReader(reader io.Reader, limiter Allower) *Reader {
+	return &Reader{reader: reader, limiter: limiter, ChunkSize: DefaultChunkSize}
+}
+
+func (reader *Reader) Read(p []byte) (int, error) {
+	// the bytes are paid after they are read, so the minimum is checked before
+	if reader.MinChunkSize > 1 && allowBetween(reader.limiter) == nil {
+		return 0, ErrMinChunkSize
+	}
+	n, err := reader.reader.Read(p[:chunk(len(p), reader.ChunkSize)])
+	if payErr := pay(reader.limiter, reader.MinChunkSize, int64(n)); payErr != nil {
+		return n, payErr
+	}
+	return n, err
+}
+
+// Writer pays before it writes and never writes more bytes at once than it got tokens for
+type Writer struct {
+	writer    io.Writer
+	limiter   Allower
+	ChunkSize int
+	// smallest grant worth waking up for, it must not exceed the capacity of any bucket on the path.
+	// The limiter has to be a token bucket or grant a minimum itself, otherwise ErrMinChunkSize is returned.
+	MinChunkSize int
+}
+
+func NewWriter(writer io.Writer, limiter Allower) *Writer {
+	return &Writer{writer: writer, limiter: limiter, ChunkSize: DefaultChunkSize}
+}
+
+func (writer *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		granted, err := acquire(writer.limiter, int64(writer.MinChunkSize), int64(chunk(len(p)-written, writer.ChunkSize)))
+		if err != nil {
+			return written, err
+		}
+		n, err := writer.writer.Write(p[written : written+int(granted)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Conn shapes both directions of a connection, a nil limiter leaves that direction unlimited
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	writer  io.Writer
+	onClose func()
+	closed  sync.Once
+}
+
+func NewConn(conn net.Conn, readLimiter Allower, writeLimiter Allower) *Conn {
+	shaped := &Conn{Conn: conn, reader: conn, writer: conn}
+	if readLimiter != nil {
+		shaped.reader = NewReader(conn, readLimiter)
+	}
+	if writeLimiter != nil {
+		shaped.writer = NewWriter(conn, writeLimiter)
+	}
+	return shaped
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *Conn) Write(p []byte) (int, error) {
+	return conn.writer.Write(p)
+}
+
+func (conn *Conn) Close() error {
+	err := conn.Conn.Close()
+	if conn.onClose != nil {
+		conn.closed.Do(conn.onClose)
+	}
+	return err
+}
+
+// Group shapes a set of connections with a limit per connection and an aggregate limit over all of them.
+// Like in StepWell every connection owns a leaf bucket whose parent is the shared root, a leaf is
+// reused once its connection is closed. Both directions of a connection are charged to the same buckets.
+type Group struct {
+	root   *stepwell.StepWellNode
+	leaves []*stepwell.StepWellNode
+	free   chan int
+	// smallest grant of a connection, at most the capacity of the connection and the aggregate buckets
+	minChunkSize int
+}
+
+func NewGroup(maxConns int, now time.Time, bucketType int, connCapacity int64, connRefillRate float64, totalCapacity int64, totalRefillRate float64) *Group {
+	if maxConns <= 0 {
+		return nil
+	}
+	root := &stepwell.StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(bucketType, totalCapacity, totalRefillRate, now)}
+	leaves := make([]*stepwell.StepWellNode, maxConns)
+	free := make(chan int, maxConns)
+	for i := range leaves {
+		leaves[i] = &stepwell.StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(bucketType, connCapacity, connRefillRate, now), Parent: root}
+		free <- i
+	}
+	minChunkSize := int64(DefaultGroupMinChunkSize)
+	if connCapacity < minChunkSize {
+		minChunkSize = connCapacity
+	}
+	if totalCapacity < minChunkSize {
+		minChunkSize = totalCapacity
+	}
+	return &Group{root: root, leaves: leaves, free: free, minChunkSize: int(minChunkSize)}
+}
+
+// Wrap shapes conn as part of the group, it fails if the group already shapes maxConns connections
+func (group *Group) Wrap(conn net.Conn) (*Conn, error) {
+	select {
+	case leaf := <-group.free:
+		shaped := NewConn(conn, group.leaves[leaf], group.leaves[leaf])
+		shaped.reader.(*Reader).MinChunkSize = group.minChunkSize
+		shaped.writer.(*Writer).MinChunkSize = group.minChunkSize
+		shaped.onClose = func() { group.free <- leaf }
+		return shaped, nil
+	default:
+		return nil, errors.New("shaping group is full")
+	}
+}
+
+var _ Allower = (tokenbucket.TokenBucketInterface)(nil)
+var _ Allower = (*stepwell.StepWellNode)(nil)
+var _ Allower = (*StepWellPort)(nil)
+var _ betweenAllower = (*stepwell.StepWellNode)(nil)
+var _ betweenAllower = (*StepWellPort)(nil)
+var _ net.Conn = (*Conn)(nil)
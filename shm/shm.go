@@ -0,0 +1,163 @@
+// Token buckets whose state lives in a memory mapped file (e.g. under /dev/shm), so several processes on one
+// host share them without a daemon. Every bucket is a single timestamp like TokenBucketHelia and is only
+// updated with atomic operations on the shared memory.
+
+package shm
+
+import (
+	"math"
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Layout of the region: a header followed by one slot per bucket, every slot on its own cache line.
+//
+//	header: magic uint64 | number of slots uint64 | capacity int64 | refill rate as float64 bits uint64
+//	        (the capacity and refill rate the region was created with, the slots may change them later)
+//	slot:   timestamp int64 | capacity int64 | refill rate inverse as float64 bits uint64
+const (
+	magic      = uint64(0x5354455057454c4c) // "STEPWELL"
+	headerSize = 64
+	slotSize   = 64
+)
+
+func regionSize(numSlots int) int {
+	return headerSize + numSlots*slotSize
+}
+
+type Region struct {
+	data     []byte
+	numSlots int
+}
+
+func (region *Region) word(offset int) *int64 {
+	return (*int64)(unsafe.Pointer(&region.data[offset]))
+}
+
+func (region *Region) NumSlots() int {
+	return region.numSlots
+}
+
+// initSlots is only called by the process which created the region, before it publishes the magic
+func (region *Region) initSlots(capacity int64, refillRate float64, now time.Time) {
+	for slot := 0; slot < region.numSlots; slot++ {
+		offset := headerSize + slot*slotSize
+		atomic.StoreInt64(region.word(offset), now.UnixNano())
+		atomic.StoreInt64(region.word(offset+8), capacity)
+		atomic.StoreInt64(region.word(offset+16), int64(math.Float64bits(1/refillRate)))
+	}
+	atomic.StoreInt64(region.word(8), int64(region.numSlots))
+	atomic.StoreInt64(region.word(16), capacity)
+	atomic.StoreInt64(region.word(24), int64(math.Float64bits(refillRate)))
+	atomic.StoreInt64(region.word(0), int64(magic))
+}
+
+func (region *Region) initialized() bool {
+	return uint64(atomic.LoadInt64(region.word(0))) == magic
+}
+
+// Bucket returns the bucket stored in slot, all processes which open the same file share it
+func (region *Region) Bucket(slot int) *TokenBucketShm {
+	offset := headerSize + slot*slotSize
+	return &TokenBucketShm{
+		timestamp:         region.word(offset),
+		capacity:          region.word(offset + 8),
+		refillRateInverse: region.word(offset + 16),
+	}
+}
+
+type TokenBucketShm struct {
+	// all fields point into the shared memory
+	timestamp         *int64
+	capacity          *int64
+	refillRateInverse *int64
+}
+
+func (bucket *TokenBucketShm) getRefillRateInverse() float64 {
+	return math.Float64frombits(uint64(atomic.LoadInt64(bucket.refillRateInverse)))
+}
+
+// SetRefillRate changes the rate for all processes sharing the bucket
+func (bucket *TokenBucketShm) SetRefillRate(refillRate float64) {
+	atomic.StoreInt64(bucket.refillRateInverse, int64(math.Float64bits(1/refillRate)))
+}
+
+func (bucket *TokenBucketShm) GetCapacity() int64 {
+	return atomic.LoadInt64(bucket.capacity)
+}
+
+func (bucket *TokenBucketShm) GetTokens() int64 {
+	capacity := bucket.GetCapacity()
+	nowUnix := time.Now().UnixNano()
+	latestTimestamp := atomic.LoadInt64(bucket.timestamp)
+	if nowUnix >= latestTimestamp {
+		return capacity
+	}
+	durationInSeconds := float64(latestTimestamp-nowUnix) / float64(time.Second)
+	used := int64(math.Ceil(durationInSeconds / bucket.getRefillRateInverse()))
+	if used > capacity {
+		return 0
+	}
+	return capacity - used
+}
+
+func (bucket *TokenBucketShm) IsAllowed(amount int64, now time.Time) bool {
+	return bucket.allow(amount, amount, now) > 0 || amount == 0
+}
+
+func (bucket *TokenBucketShm) AllowUpTo(max int64, now time.Time) int64 {
+	return bucket.allow(1, max, now)
+}
+
+// allow grants between min and max tokens, the same algorithm as TokenBucketHelia on the shared timestamp
+func (bucket *TokenBucketShm) allow(min int64, max int64, now time.Time) int64 {
+	refillRateInverse := bucket.getRefillRateInverse()
+	T := int64(float64(bucket.GetCapacity()) * refillRateInverse * float64(time.Second))
+	tokenTime := refillRateInverse * float64(time.Second)
+
+	nowUnix := now.UnixNano()
+	for {
+		latestTimestamp := atomic.LoadInt64(bucket.timestamp)
+		base := latestTimestamp
+		if nowUnix > latestTimestamp {
+			base = nowUnix
+		}
+
+		available := int64(float64(nowUnix+T-base) / tokenTime)
+		granted := max
+		if available < granted {
+			granted = available
+		}
+		if granted < min || granted <= 0 {
+			return 0
+		}
+
+		newTimestamp := base + int64(float64(granted)*tokenTime)
+		if atomic.CompareAndSwapInt64(bucket.timestamp, latestTimestamp, newTimestamp) {
+			return granted
+		}
+	}
+}
+
+func (bucket *TokenBucketShm) ReturnTokens(amount int64) {
+	packetTime := int64(float64(amount) * bucket.getRefillRateInverse() * float64(time.Second))
+	atomic.AddInt64(bucket.timestamp, -packetTime)
+}
+
+// NewSharedStepwell opens (or creates) a region holding a whole StepWell tree with one leaf per process.
+// Every process opens the same file with the same numProcesses and uses its own index as port.
+func NewSharedStepwell(path string, numProcesses uint64, now time.Time, capacity int64, refillRate float64) (*stepwell.StepWell, *Region, error) {
+	region, err := OpenRegion(path, int(stepwell.NumNodes(numProcesses)), capacity, refillRate, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	stepwell := stepwell.NewStepwellWithBuckets(numProcesses, capacity, refillRate, func(index int) tokenbucket.TokenBucketInterface {
+		return region.Bucket(index)
+	})
+	return stepwell, region, nil
+}
+
+var _ tokenbucket.TokenBucketInterface = (*TokenBucketShm)(nil)
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package shm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenRegion maps the file at path. The first process creates and initializes it with full buckets,
+// every later process maps the existing state and must ask for the same slots, capacity and refill rate.
+// All processes hold an exclusive flock while they look at the header, so nobody maps a region which is
+// still being initialized. A region whose creator died before it published the magic is initialized again.
+func OpenRegion(path string, numSlots int, capacity int64, refillRate float64, now time.Time) (*Region, error) {
+	size := regionSize(numSlots)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		return nil, err
+	}
+	// the mapping keeps the open file alive, so closing the file alone would not release the lock
+	defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+	initialized, err := checkHeader(file, numSlots, capacity, refillRate)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		// the file is either new or left behind half initialized, start over with empty slots
+		if err := file.Truncate(0); err != nil {
+			return nil, err
+		}
+		if err := file.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := unix.Mmap(int(file.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	region := &Region{data: data, numSlots: numSlots}
+	if !initialized {
+		region.initSlots(capacity, refillRate, now)
+	}
+	return region, nil
+}
+
+// checkHeader reports whether the file holds an initialized region and fails if it was created with other parameters
+func checkHeader(file *os.File, numSlots int, capacity int64, refillRate float64) (bool, error) {
+	var header [32]byte
+	if _, err := file.ReadAt(header[:], 0); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	// the header was written with atomic stores in the byte order of this host
+	order := binary.NativeEndian
+	if order.Uint64(header[0:]) != magic {
+		return false, nil
+	}
+	name := file.Name()
+	if int(order.Uint64(header[8:])) != numSlots {
+		return false, errors.New("shared region " + name + " has a different number of slots")
+	}
+	if int64(order.Uint64(header[16:])) != capacity {
+		return false, errors.New("shared region " + name + " was created with a different capacity")
+	}
+	if math.Float64frombits(order.Uint64(header[24:])) != refillRate {
+		return false, errors.New("shared region " + name + " was created with a different refill rate")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != int64(regionSize(numSlots)) {
+		return false, errors.New("shared region " + name + " has a different size")
+	}
+	return true, nil
+}
+
+func (region *Region) Close() error {
+	return unix.Munmap(region.data)
+}
@@ -8,6 +8,14 @@ import (
 type StepWellInterface interface {
 	//Get a token for all the buckets on the path to the single bucket which is the root of the tree and the bottom layer of the StepWell tree structure
 	IsAllowed(port uint64, amount int64, now time.Time) bool
+	//Get as many tokens as possible but at most max on the path, returns the smallest grant along the path
+	AllowUpTo(port uint64, max int64, now time.Time) int64
+	//Like AllowUpTo but grants nothing if the path can not grant at least min tokens
+	AllowBetween(port uint64, min int64, max int64, now time.Time) int64
+	//Get the tokens left on the path, which is the smallest number of tokens of all buckets on the path
+	GetTokens(port uint64) int64
+	//Like GetTokens but buckets whose tokens depend on the time answer for now instead of the wall clock
+	GetTokensAt(port uint64, now time.Time) int64
 }
 
 type StepWell struct {
@@ -31,12 +39,26 @@ type StepWellNode struct {
 }
 
 func NewStepwell(numCores uint64, now time.Time, bucketType int, capacity int64, refillRate float64) *StepWell {
+	stepwell := NewStepwellWithBuckets(numCores, capacity, refillRate, func(index int) tokenbucket.TokenBucketInterface {
+		return tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now)
+	})
+	if stepwell != nil {
+		stepwell.bucketType = bucketType
+	}
+	return stepwell
+}
+
+// NewStepwellWithBuckets builds the same tree as NewStepwell but asks newBucket for the bucket of every node.
+// The nodes are created level by level starting at the root, index counts them in this order.
+func NewStepwellWithBuckets(numCores uint64, capacity int64, refillRate float64, newBucket func(index int) tokenbucket.TokenBucketInterface) *StepWell {
 	if numCores <= 0 {
 		return nil
 	}
 
+	index := 0
 	var nodes []*StepWellNode
-	root := &StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now)}
+	root := &StepWellNode{TokenBucket: newBucket(index)}
+	index++
 	nodes = append(nodes, root)
 
 	for levelCount := uint64(1); levelCount < numCores; {
@@ -46,7 +68,8 @@ func NewStepwell(numCores uint64, now time.Time, bucketType int, capacity int64,
 			if levelCount >= numCores {
 				break
 			}
-			leftChild := &StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now), Parent: node}
+			leftChild := &StepWellNode{TokenBucket: newBucket(index), Parent: node}
+			index++
 			node.leftChild = leftChild
 			nextLevel = append(nextLevel, leftChild)
 			levelCount++
@@ -54,7 +77,8 @@ func NewStepwell(numCores uint64, now time.Time, bucketType int, capacity int64,
 			if levelCount >= numCores {
 				break
 			}
-			rightChild := &StepWellNode{TokenBucket: tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now), Parent: node}
+			rightChild := &StepWellNode{TokenBucket: newBucket(index), Parent: node}
+			index++
 			node.rightChild = rightChild
 			nextLevel = append(nextLevel, rightChild)
 			levelCount++
@@ -68,13 +92,132 @@ func NewStepwell(numCores uint64, now time.Time, bucketType int, capacity int64,
 		numCores:   numCores,
 		Capacity:   capacity,
 		refillRate: refillRate,
-		bucketType: bucketType,
 	}
 }
 
+// NewStepwellWithQuota builds a StepWell whose root checks the calendar quota on top of its token bucket,
+// e.g. a burst of 10/s per core and 1M/day for all cores together. The quota may be shared by several StepWells.
+func NewStepwellWithQuota(numCores uint64, now time.Time, bucketType int, capacity int64, refillRate float64, quota *tokenbucket.TokenBucketCalendar) *StepWell {
+	stepwell := NewStepwellWithBuckets(numCores, capacity, refillRate, func(index int) tokenbucket.TokenBucketInterface {
+		bucket := tokenbucket.NewTokenBucketByType(bucketType, capacity, refillRate, now)
+		if index == 0 {
+			return tokenbucket.NewTokenBucketComposite(bucket, quota)
+		}
+		return bucket
+	})
+	if stepwell != nil {
+		stepwell.bucketType = bucketType
+	}
+	return stepwell
+}
+
+// NumNodes returns how many nodes the tree of a StepWell with numCores leaves has
+func NumNodes(numCores uint64) uint64 {
+	if numCores <= 0 {
+		return 0
+	}
+	total := uint64(1)
+	for levelCount := uint64(1); levelCount < numCores; {
+		levelCount *= 2
+		if levelCount > numCores {
+			levelCount = numCores
+		}
+		total += levelCount
+	}
+	return total
+}
+
+// ParentIndexes returns the index of the parent of every node in the order NewStepwellWithBuckets creates
+// them, -1 for the root. The leaf of port p has the index NumNodes(numCores)-numCores+p.
+// It lets other trees with the shape of a StepWell keep their nodes in a plain slice.
+func ParentIndexes(numCores uint64) []int {
+	stepwell := NewStepwellWithBuckets(numCores, 0, 0, func(index int) tokenbucket.TokenBucketInterface {
+		return nil
+	})
+	if stepwell == nil {
+		return nil
+	}
+	nodes := stepwell.nodes()
+	indexes := make(map[*StepWellNode]int, len(nodes))
+	parents := make([]int, len(nodes))
+	for i, node := range nodes {
+		indexes[node] = i
+		parents[i] = -1
+		if node.Parent != nil {
+			parents[i] = indexes[node.Parent]
+		}
+	}
+	return parents
+}
+
 func (stepwell *StepWell) IsAllowed(port uint64, amount int64, now time.Time) bool {
+	return stepwell.Cores[port].IsAllowed(amount, now)
+}
+
+func (stepwell *StepWell) AllowUpTo(port uint64, max int64, now time.Time) int64 {
+	return stepwell.Cores[port].AllowUpTo(max, now)
+}
+
+func (stepwell *StepWell) AllowBetween(port uint64, min int64, max int64, now time.Time) int64 {
+	return stepwell.Cores[port].AllowBetween(min, max, now)
+}
+
+func (stepwell *StepWell) GetTokens(port uint64) int64 {
+	var curr *StepWellNode = stepwell.Cores[port]
+
+	tokens := curr.TokenBucket.GetTokens()
+	for curr.Parent != nil {
+		curr = curr.Parent
+		if parentTokens := curr.TokenBucket.GetTokens(); parentTokens < tokens {
+			tokens = parentTokens
+		}
+	}
+	return tokens
+}
+
+func (stepwell *StepWell) GetTokensAt(port uint64, now time.Time) int64 {
 	var curr *StepWellNode = stepwell.Cores[port]
 
+	tokens := tokenbucket.GetTokensAt(curr.TokenBucket, now)
+	for curr.Parent != nil {
+		curr = curr.Parent
+		if parentTokens := tokenbucket.GetTokensAt(curr.TokenBucket, now); parentTokens < tokens {
+			tokens = parentTokens
+		}
+	}
+	return tokens
+}
+
+// SetRefillRate changes the rate of every node, all nodes of a StepWell refill at the same rate
+func (stepwell *StepWell) SetRefillRate(refillRate float64) {
+	stepwell.refillRate = refillRate
+	for _, node := range stepwell.nodes() {
+		node.TokenBucket.SetRefillRate(refillRate)
+	}
+}
+
+// SetCapacity changes the capacity of every node whose bucket supports it
+func (stepwell *StepWell) SetCapacity(capacity int64) {
+	stepwell.Capacity = capacity
+	for _, node := range stepwell.nodes() {
+		if setter, ok := node.TokenBucket.(tokenbucket.CapacitySetter); ok {
+			setter.SetCapacity(capacity)
+		}
+	}
+}
+
+func (stepwell *StepWell) GetRefillRate() float64 {
+	return stepwell.refillRate
+}
+
+func (stepwell *StepWell) GetNumCores() uint64 {
+	return stepwell.numCores
+}
+
+// IsAllowed charges this node and all its parents up to the root, other trees built from StepWellNodes use it as well
+func (node *StepWellNode) IsAllowed(amount int64, now time.Time) bool {
+	var curr *StepWellNode = node
+
 	if !curr.TokenBucket.IsAllowed(amount, now) {
 		return false
 	}
@@ -88,4 +231,39 @@ func (stepwell *StepWell) IsAllowed(port uint64, amount int64, now time.Time) bo
 	return true
 }
 
+func (node *StepWellNode) AllowUpTo(max int64, now time.Time) int64 {
+	return node.AllowBetween(1, max, now)
+}
+
+// AllowBetween asks every bucket on the path for what the buckets below it granted. Unlike IsAllowed a
+// partial grant does not overcharge the buckets below, they get back what they granted beyond the final grant.
+// If the final grant is smaller than min all buckets get back everything and nothing is granted.
+func (node *StepWellNode) AllowBetween(min int64, max int64, now time.Time) int64 {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		return 0
+	}
+	// the paths of a StepWell are short, the grants stay on the stack
+	var buffer [64]int64
+	grants := buffer[:0]
+	granted := max
+	for curr := node; curr != nil && granted >= min; curr = curr.Parent {
+		granted = curr.TokenBucket.AllowUpTo(granted, now)
+		grants = append(grants, granted)
+	}
+	if granted < min {
+		granted = 0
+	}
+	curr := node
+	for _, grant := range grants {
+		if grant > granted {
+			tokenbucket.ReturnTokensAt(curr.TokenBucket, grant-granted, now)
+		}
+		curr = curr.Parent
+	}
+	return granted
+}
+
 var _ StepWellInterface = (*StepWell)(nil)
@@ -0,0 +1,146 @@
+package stepwell
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"stepwell/tokenbucket"
+)
+
+const snapshotVersion = 1
+
+// a snapshot is untrusted input, no real machine has more cores than this
+const maxSnapshotCores = 1 << 16
+
+// stepWellState is the JSON snapshot of a StepWell. The shape of the tree follows from numCores,
+// the buckets of the nodes are stored in the order NewStepwellWithBuckets creates them.
+type stepWellState struct {
+	NumCores   uint64            `json:"numCores"`
+	BucketType int               `json:"bucketType"`
+	Capacity   int64             `json:"capacity"`
+	RefillRate float64           `json:"refillRate"`
+	Nodes      []json.RawMessage `json:"nodes"`
+}
+
+// nodes returns all nodes level by level starting at the root, which is the order they were created in
+func (stepwell *StepWell) nodes() []*StepWellNode {
+	nodes := []*StepWellNode{stepwell.root}
+	for i := 0; i < len(nodes); i++ {
+		if nodes[i].leftChild != nil {
+			nodes = append(nodes, nodes[i].leftChild)
+		}
+		if nodes[i].rightChild != nil {
+			nodes = append(nodes, nodes[i].rightChild)
+		}
+	}
+	return nodes
+}
+
+// restore replaces the StepWell with a tree of the given shape whose buckets come from newBucket
+func (stepwell *StepWell) restore(numCores uint64, bucketType int, capacity int64, refillRate float64, numNodes int, newBucket func(index int) (tokenbucket.TokenBucketInterface, error)) error {
+	if numCores <= 0 || numCores > maxSnapshotCores || uint64(numNodes) != NumNodes(numCores) {
+		return errors.New("snapshot does not match the shape of a StepWell")
+	}
+	var err error
+	restored := NewStepwellWithBuckets(numCores, capacity, refillRate, func(index int) tokenbucket.TokenBucketInterface {
+		bucket, bucketErr := newBucket(index)
+		if bucketErr != nil && err == nil {
+			err = bucketErr
+		}
+		return bucket
+	})
+	if err != nil {
+		return err
+	}
+	restored.bucketType = bucketType
+	*stepwell = *restored
+	return nil
+}
+
+func (stepwell *StepWell) MarshalBinary() ([]byte, error) {
+	data := []byte{snapshotVersion}
+	data = binary.BigEndian.AppendUint64(data, stepwell.numCores)
+	data = binary.BigEndian.AppendUint64(data, uint64(stepwell.bucketType))
+	data = binary.BigEndian.AppendUint64(data, uint64(stepwell.Capacity))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(stepwell.refillRate))
+
+	nodes := stepwell.nodes()
+	data = binary.BigEndian.AppendUint64(data, uint64(len(nodes)))
+	for _, node := range nodes {
+		bucket, err := tokenbucket.MarshalTokenBucket(node.TokenBucket)
+		if err != nil {
+			return nil, err
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(bucket)))
+		data = append(data, bucket...)
+	}
+	return data, nil
+}
+
+func (stepwell *StepWell) UnmarshalBinary(data []byte) error {
+	const headerSize = 1 + 5*8
+	if len(data) < headerSize {
+		return errors.New("invalid StepWell snapshot length")
+	}
+	if data[0] != snapshotVersion {
+		return errors.New("unknown snapshot version")
+	}
+	numCores := binary.BigEndian.Uint64(data[1:])
+	bucketType := int(binary.BigEndian.Uint64(data[9:]))
+	capacity := int64(binary.BigEndian.Uint64(data[17:]))
+	refillRate := math.Float64frombits(binary.BigEndian.Uint64(data[25:]))
+	numNodes := binary.BigEndian.Uint64(data[33:])
+	if numCores <= 0 || numCores > maxSnapshotCores || numNodes != NumNodes(numCores) {
+		return errors.New("snapshot does not match the shape of a StepWell")
+	}
+	// every node needs at least its length prefix, so the header can not make us allocate more than the data
+	if numNodes > uint64(len(data)-headerSize)/4 {
+		return errors.New("invalid StepWell snapshot length")
+	}
+
+	buckets := make([][]byte, numNodes)
+	rest := data[headerSize:]
+	for i := range buckets {
+		if len(rest) < 4 {
+			return errors.New("invalid StepWell snapshot length")
+		}
+		length := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+length {
+			return errors.New("invalid StepWell snapshot length")
+		}
+		buckets[i] = rest[4 : 4+length]
+		rest = rest[4+length:]
+	}
+
+	return stepwell.restore(numCores, bucketType, capacity, refillRate, len(buckets), func(index int) (tokenbucket.TokenBucketInterface, error) {
+		return tokenbucket.UnmarshalTokenBucket(buckets[index])
+	})
+}
+
+func (stepwell *StepWell) MarshalJSON() ([]byte, error) {
+	state := stepWellState{
+		NumCores:   stepwell.numCores,
+		BucketType: stepwell.bucketType,
+		Capacity:   stepwell.Capacity,
+		RefillRate: stepwell.refillRate,
+	}
+	for _, node := range stepwell.nodes() {
+		bucket, err := tokenbucket.MarshalTokenBucketJSON(node.TokenBucket)
+		if err != nil {
+			return nil, err
+		}
+		state.Nodes = append(state.Nodes, bucket)
+	}
+	return json.Marshal(state)
+}
+
+func (stepwell *StepWell) UnmarshalJSON(data []byte) error {
+	var state stepWellState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	return stepwell.restore(state.NumCores, state.BucketType, state.Capacity, state.RefillRate, len(state.Nodes), func(index int) (tokenbucket.TokenBucketInterface, error) {
+		return tokenbucket.UnmarshalTokenBucketJSON(state.Nodes[index])
+	})
+}
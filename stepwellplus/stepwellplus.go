@@ -8,6 +8,7 @@ import (
 
 type StepWellPlusInterface interface {
 	IsAllowed(port uint64, amount int64, now time.Time) bool
+	AllowUpTo(port uint64, max int64, now time.Time) int64
 	StartWorker()
 	StopWorker()
 }
@@ -58,6 +59,34 @@ func (stepwellplus *StepWellPlus) IsAllowed(port uint64, amount int64, now time.
 	return core.TokenBucket.IsAllowed(amount, now)
 }
 
+func (stepwellplus *StepWellPlus) AllowUpTo(port uint64, max int64, now time.Time) int64 {
+	core := stepwellplus.Cores[port]
+	atomic.AddInt64(&core.requests, 1)
+	return core.TokenBucket.AllowUpTo(max, now)
+}
+
+// SetRefillRate changes the total rate of all cores. It is split evenly until the worker rebalances it by demand.
+func (stepwellplus *StepWellPlus) SetRefillRate(refillRate float64) {
+	stepwellplus.refillRate = refillRate
+	for _, core := range stepwellplus.Cores {
+		core.TokenBucket.SetRefillRate(refillRate / float64(stepwellplus.numCores))
+	}
+}
+
+// SetCapacity changes the total capacity of all cores, every core gets the same share of it
+func (stepwellplus *StepWellPlus) SetCapacity(capacity int64) {
+	stepwellplus.Capacity = capacity
+	for _, core := range stepwellplus.Cores {
+		if setter, ok := core.TokenBucket.(tokenbucket.CapacitySetter); ok {
+			setter.SetCapacity(capacity / int64(stepwellplus.numCores))
+		}
+	}
+}
+
+func (stepwellplus *StepWellPlus) GetRefillRate() float64 {
+	return stepwellplus.refillRate
+}
+
 func (stepwellplus *StepWellPlus) StartWorker() {
 	if stepwellplus.workerRunning {
 		return
@@ -0,0 +1,132 @@
+package stepwellplus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"stepwell/tokenbucket"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// The snapshot holds the configuration and the bucket of every core. The request counters and the
+// worker are not part of it, a restored StepWellPlus starts with a stopped worker.
+type stepWellPlusState struct {
+	NumCores     uint64            `json:"numCores"`
+	RefreshDelay time.Duration     `json:"refreshDelay"`
+	BucketType   int               `json:"bucketType"`
+	Capacity     int64             `json:"capacity"`
+	RefillRate   float64           `json:"refillRate"`
+	Cores        []json.RawMessage `json:"cores"`
+}
+
+func (stepwellplus *StepWellPlus) restore(numCores uint64, refreshDelay time.Duration, bucketType int, capacity int64, refillRate float64, buckets []tokenbucket.TokenBucketInterface) error {
+	if numCores <= 0 || uint64(len(buckets)) != numCores {
+		return errors.New("snapshot does not have a bucket for every core")
+	}
+	if stepwellplus.workerRunning {
+		return errors.New("can not restore a StepWellPlus while its worker is running")
+	}
+	cores := make([]*StepWellPlusNode, numCores)
+	for i, bucket := range buckets {
+		cores[i] = &StepWellPlusNode{TokenBucket: bucket}
+	}
+	*stepwellplus = StepWellPlus{
+		Cores:        cores,
+		numCores:     numCores,
+		refreshDelay: refreshDelay,
+		stopChan:     make(chan struct{}),
+		Capacity:     capacity,
+		refillRate:   refillRate,
+		bucketType:   bucketType,
+	}
+	return nil
+}
+
+func (stepwellplus *StepWellPlus) MarshalBinary() ([]byte, error) {
+	data := []byte{snapshotVersion}
+	data = binary.BigEndian.AppendUint64(data, stepwellplus.numCores)
+	data = binary.BigEndian.AppendUint64(data, uint64(stepwellplus.refreshDelay))
+	data = binary.BigEndian.AppendUint64(data, uint64(stepwellplus.bucketType))
+	data = binary.BigEndian.AppendUint64(data, uint64(stepwellplus.Capacity))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(stepwellplus.refillRate))
+	for _, core := range stepwellplus.Cores {
+		bucket, err := tokenbucket.MarshalTokenBucket(core.TokenBucket)
+		if err != nil {
+			return nil, err
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(bucket)))
+		data = append(data, bucket...)
+	}
+	return data, nil
+}
+
+func (stepwellplus *StepWellPlus) UnmarshalBinary(data []byte) error {
+	const headerSize = 1 + 5*8
+	if len(data) < headerSize {
+		return errors.New("invalid StepWellPlus snapshot length")
+	}
+	if data[0] != snapshotVersion {
+		return errors.New("unknown snapshot version")
+	}
+	numCores := binary.BigEndian.Uint64(data[1:])
+	refreshDelay := time.Duration(binary.BigEndian.Uint64(data[9:]))
+	bucketType := int(binary.BigEndian.Uint64(data[17:]))
+	capacity := int64(binary.BigEndian.Uint64(data[25:]))
+	refillRate := math.Float64frombits(binary.BigEndian.Uint64(data[33:]))
+
+	var buckets []tokenbucket.TokenBucketInterface
+	rest := data[headerSize:]
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return errors.New("invalid StepWellPlus snapshot length")
+		}
+		length := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+length {
+			return errors.New("invalid StepWellPlus snapshot length")
+		}
+		bucket, err := tokenbucket.UnmarshalTokenBucket(rest[4 : 4+length])
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, bucket)
+		rest = rest[4+length:]
+	}
+	return stepwellplus.restore(numCores, refreshDelay, bucketType, capacity, refillRate, buckets)
+}
+
+func (stepwellplus *StepWellPlus) MarshalJSON() ([]byte, error) {
+	state := stepWellPlusState{
+		NumCores:     stepwellplus.numCores,
+		RefreshDelay: stepwellplus.refreshDelay,
+		BucketType:   stepwellplus.bucketType,
+		Capacity:     stepwellplus.Capacity,
+		RefillRate:   stepwellplus.refillRate,
+	}
+	for _, core := range stepwellplus.Cores {
+		bucket, err := tokenbucket.MarshalTokenBucketJSON(core.TokenBucket)
+		if err != nil {
+			return nil, err
+		}
+		state.Cores = append(state.Cores, bucket)
+	}
+	return json.Marshal(state)
+}
+
+func (stepwellplus *StepWellPlus) UnmarshalJSON(data []byte) error {
+	var state stepWellPlusState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	var buckets []tokenbucket.TokenBucketInterface
+	for _, core := range state.Cores {
+		bucket, err := tokenbucket.UnmarshalTokenBucketJSON(core)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, bucket)
+	}
+	return stepwellplus.restore(state.NumCores, state.RefreshDelay, state.BucketType, state.Capacity, state.RefillRate, buckets)
+}
@@ -0,0 +1,169 @@
+package tcm
+
+import (
+	"math"
+	"stepwell/stepwell"
+	"sync"
+	"time"
+)
+
+// The committed and excess bucket of the srTCM are not independent: the excess bucket only receives
+// the tokens which overflow the full committed bucket. The token bucket types can not hand out their
+// overflow, so the srTCM keeps both counters itself under one lock.
+type SrTCM struct {
+	//committed information rate in tokens per second
+	cir float64
+	//committed and excess burst size
+	cbs int64
+	ebs int64
+	tc  int64
+	te  int64
+	// Store as Unix timestamp in nanoseconds
+	lastRefill int64
+	sync.Mutex
+}
+
+func NewSrTCM(cbs int64, ebs int64, cir float64, now time.Time) *SrTCM {
+	return &SrTCM{
+		cir: cir,
+		cbs: cbs,
+		ebs: ebs,
+		//both buckets start full
+		tc:         cbs,
+		te:         ebs,
+		lastRefill: now.UnixNano(),
+	}
+}
+
+func (meter *SrTCM) refillTokens(now time.Time) {
+	duration := now.UnixNano() - meter.lastRefill
+	tokensToAdd := int64(math.Floor(meter.cir / 1_000_000_000 * float64(duration)))
+
+	if tokensToAdd > 0 {
+		meter.lastRefill = now.UnixNano()
+		meter.tc += tokensToAdd
+		if meter.tc > meter.cbs {
+			meter.te += meter.tc - meter.cbs
+			meter.tc = meter.cbs
+			if meter.te > meter.ebs {
+				meter.te = meter.ebs
+			}
+		}
+	}
+}
+
+func (meter *SrTCM) SetRefillRate(cir float64) {
+	meter.Lock()
+	defer meter.Unlock()
+	meter.cir = cir
+}
+
+func (meter *SrTCM) Mark(amount int64, now time.Time) Color {
+	return meter.MarkAware(amount, Green, now)
+}
+
+func (meter *SrTCM) MarkAware(amount int64, preColor Color, now time.Time) Color {
+	meter.Lock()
+	defer meter.Unlock()
+	meter.refillTokens(now)
+
+	if preColor == Green && meter.tc >= amount {
+		meter.tc -= amount
+		return Green
+	}
+	if preColor != Red && meter.te >= amount {
+		meter.te -= amount
+		return Yellow
+	}
+	return Red
+}
+
+// take charges amount to the committed bucket for green and to the excess bucket for yellow
+func (meter *SrTCM) take(amount int64, color Color, now time.Time) bool {
+	meter.Lock()
+	defer meter.Unlock()
+	meter.refillTokens(now)
+
+	tokens := &meter.tc
+	if color == Yellow {
+		tokens = &meter.te
+	}
+	if *tokens < amount {
+		return false
+	}
+	*tokens -= amount
+	return true
+}
+
+// giveBack undoes take, the bucket never grows beyond its burst size
+func (meter *SrTCM) giveBack(amount int64, color Color) {
+	meter.Lock()
+	defer meter.Unlock()
+	tokens, burst := &meter.tc, meter.cbs
+	if color == Yellow {
+		tokens, burst = &meter.te, meter.ebs
+	}
+	*tokens += amount
+	if *tokens > burst {
+		*tokens = burst
+	}
+}
+
+// Multi-core srTCM: every node of a StepWell shaped tree is a srTCM, a core walks the path from its leaf to the
+// root. A request is green if every meter on the path has committed tokens for it and yellow if every meter
+// has excess tokens for it. The meters of a color which is not granted on the whole path get their tokens back.
+type SrTCMStepWell struct {
+	// the meters in the order NewStepwellWithBuckets creates the nodes, the root first and the leaves last
+	Meters   []*SrTCM
+	parents  []int
+	numCores uint64
+}
+
+func NewSrTCMStepwell(numCores uint64, now time.Time, cbs int64, ebs int64, cir float64) *SrTCMStepWell {
+	parents := stepwell.ParentIndexes(numCores)
+	if parents == nil {
+		return nil
+	}
+	meters := make([]*SrTCM, len(parents))
+	for i := range meters {
+		meters[i] = NewSrTCM(cbs, ebs, cir, now)
+	}
+	return &SrTCMStepWell{Meters: meters, parents: parents, numCores: numCores}
+}
+
+func (meter *SrTCMStepWell) SetRefillRate(cir float64) {
+	for _, node := range meter.Meters {
+		node.SetRefillRate(cir)
+	}
+}
+
+func (meter *SrTCMStepWell) Mark(port uint64, amount int64, now time.Time) Color {
+	return meter.MarkAware(port, amount, Green, now)
+}
+
+func (meter *SrTCMStepWell) MarkAware(port uint64, amount int64, preColor Color, now time.Time) Color {
+	if preColor == Green && meter.takePath(port, amount, Green, now) {
+		return Green
+	}
+	if preColor != Red && meter.takePath(port, amount, Yellow, now) {
+		return Yellow
+	}
+	return Red
+}
+
+// takePath charges color on every meter from the leaf of port to the root or on none of them
+func (meter *SrTCMStepWell) takePath(port uint64, amount int64, color Color, now time.Time) bool {
+	leaf := len(meter.Meters) - int(meter.numCores) + int(port)
+	for i := leaf; i >= 0; i = meter.parents[i] {
+		if !meter.Meters[i].take(amount, color, now) {
+			for taken := leaf; taken != i; taken = meter.parents[taken] {
+				meter.Meters[taken].giveBack(amount, color)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+var _ MarkerInterface = (*SrTCM)(nil)
+var _ StepWellMarkerInterface = (*SrTCMStepWell)(nil)
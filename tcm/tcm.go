@@ -0,0 +1,42 @@
+// Three color markers as used for DSCP re-marking: instead of allowed/denied every request is colored.
+// srTCM: https://www.rfc-editor.org/rfc/rfc2697
+// trTCM: https://www.rfc-editor.org/rfc/rfc2698
+
+package tcm
+
+import (
+	"time"
+)
+
+type Color int
+
+const (
+	Green Color = iota
+	Yellow
+	Red
+)
+
+func (color Color) String() string {
+	switch color {
+	case Green:
+		return "green"
+	case Yellow:
+		return "yellow"
+	case Red:
+		return "red"
+	default:
+		return "unknown"
+	}
+}
+
+// Color-blind metering is the same as color-aware metering of a packet which arrives green,
+// so every marker only implements MarkAware and Mark passes Green.
+type MarkerInterface interface {
+	Mark(amount int64, now time.Time) Color
+	MarkAware(amount int64, preColor Color, now time.Time) Color
+}
+
+type StepWellMarkerInterface interface {
+	Mark(port uint64, amount int64, now time.Time) Color
+	MarkAware(port uint64, amount int64, preColor Color, now time.Time) Color
+}
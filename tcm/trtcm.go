@@ -0,0 +1,72 @@
+package tcm
+
+import (
+	"stepwell/stepwell"
+	"stepwell/tokenbucket"
+	"time"
+)
+
+// In the trTCM the peak and committed bucket refill independently, so any bucketType can be used for them.
+// The peak bucket is checked first: a request which does not fit into it is red and charges nothing,
+// a yellow request only charges the peak bucket and a green request charges both.
+type TrTCM struct {
+	Committed tokenbucket.TokenBucketInterface
+	Peak      tokenbucket.TokenBucketInterface
+}
+
+func NewTrTCM(bucketType int, cbs int64, cir float64, pbs int64, pir float64, now time.Time) *TrTCM {
+	return &TrTCM{
+		Committed: tokenbucket.NewTokenBucketByType(bucketType, cbs, cir, now),
+		Peak:      tokenbucket.NewTokenBucketByType(bucketType, pbs, pir, now),
+	}
+}
+
+func (meter *TrTCM) Mark(amount int64, now time.Time) Color {
+	return meter.MarkAware(amount, Green, now)
+}
+
+func (meter *TrTCM) MarkAware(amount int64, preColor Color, now time.Time) Color {
+	if preColor == Red || !meter.Peak.IsAllowed(amount, now) {
+		return Red
+	}
+	if preColor == Yellow || !meter.Committed.IsAllowed(amount, now) {
+		return Yellow
+	}
+	return Green
+}
+
+// Multi-core trTCM: the committed and the peak buckets are each a StepWell tree, a core only
+// walks its own path in both trees.
+type TrTCMStepWell struct {
+	Committed *stepwell.StepWell
+	Peak      *stepwell.StepWell
+}
+
+func NewTrTCMStepwell(numCores uint64, now time.Time, bucketType int, cbs int64, cir float64, pbs int64, pir float64) *TrTCMStepWell {
+	if numCores <= 0 {
+		return nil
+	}
+	return &TrTCMStepWell{
+		Committed: stepwell.NewStepwell(numCores, now, bucketType, cbs, cir),
+		Peak:      stepwell.NewStepwell(numCores, now, bucketType, pbs, pir),
+	}
+}
+
+func (meter *TrTCMStepWell) Mark(port uint64, amount int64, now time.Time) Color {
+	return meter.MarkAware(port, amount, Green, now)
+}
+
+// Unlike StepWell.IsAllowed a tree which can not grant the whole amount charges none of its nodes,
+// so a request which ends up red or yellow leaves the buckets it did not get a color from untouched
+func (meter *TrTCMStepWell) MarkAware(port uint64, amount int64, preColor Color, now time.Time) Color {
+	if preColor == Red || meter.Peak.AllowBetween(port, amount, amount, now) != amount {
+		return Red
+	}
+	if preColor == Yellow || meter.Committed.AllowBetween(port, amount, amount, now) != amount {
+		return Yellow
+	}
+	return Green
+}
+
+var _ MarkerInterface = (*TrTCM)(nil)
+var _ StepWellMarkerInterface = (*TrTCMStepWell)(nil)
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"stepwell/distributed"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RunDistributedLeaf sends as many requests as possible from numCores goroutines through a StepWell whose root
+// is the root service at rootAddr and returns how many were allowed. The local buckets are large enough to
+// never deny a request, so only the root limits the leaf.
+func RunDistributedLeaf(rootAddr string, numCores uint64, bucketType int, leaseSize int64, duration time.Duration) int64 {
+	root := distributed.NewRemoteBucket(rootAddr, leaseSize, time.Second, distributed.FailClosed)
+	defer root.Close()
+	tree := distributed.NewDistributedStepwell(numCores, time.Now(), bucketType, 1<<40, 1<<40, root)
+
+	var allowed int64
+	var wait sync.WaitGroup
+	deadline := time.Now().Add(duration)
+	for core := uint64(0); core < numCores; core++ {
+		wait.Add(1)
+		go func(core uint64) {
+			defer wait.Done()
+			for now := time.Now(); now.Before(deadline); now = time.Now() {
+				if tree.IsAllowed(core, 1, now) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}(core)
+	}
+	wait.Wait()
+	return allowed
+}
+
+// freeAddr returns a localhost address which nobody listens on right now
+func freeAddr() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+// TestDistributed starts a root service and numLeaves leaf processes of this binary on localhost.
+// All leaves together must not get more than the root bucket holds plus what it refills while they run,
+// and they have to get most of it.
+func TestDistributed(numLeaves int, bucketType int, duration int, refillRateInt int, capacityInt int) error {
+	capacity := int64(capacityInt)
+	refillRate := float64(refillRateInt)
+	addr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+
+	root := exec.Command(os.Args[0], "root", addr, strconv.Itoa(bucketType), strconv.FormatInt(capacity, 10), strconv.FormatFloat(refillRate, 'f', -1, 64))
+	root.Stderr = os.Stderr
+	if err := root.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		root.Process.Kill()
+		root.Wait()
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			return fmt.Errorf("root service on %s did not start: %v", addr, err)
+		}
+	}
+
+	// the root bucket starts full, so it may hand out its capacity on top of the refill of the whole run
+	start := time.Now()
+	leaves := make([]*exec.Cmd, numLeaves)
+	outputs := make([]strings.Builder, numLeaves)
+	for i := range leaves {
+		leaves[i] = exec.Command(os.Args[0], "leaf", addr, "2", strconv.Itoa(bucketType), "10", strconv.Itoa(duration))
+		leaves[i].Stdout = &outputs[i]
+		leaves[i].Stderr = os.Stderr
+		if err := leaves[i].Start(); err != nil {
+			return err
+		}
+	}
+
+	total := int64(0)
+	for i, leaf := range leaves {
+		if err := leaf.Wait(); err != nil {
+			return fmt.Errorf("leaf %d failed: %v", i, err)
+		}
+		allowed, err := parseAllowed(outputs[i].String())
+		if err != nil {
+			return fmt.Errorf("leaf %d: %v", i, err)
+		}
+		fmt.Printf("Leaf %d: allowed %d\n", i, allowed)
+		total += allowed
+	}
+	elapsed := time.Since(start)
+
+	upperBound := float64(capacity) + refillRate*elapsed.Seconds()
+	// the leaves start a little later than the root and only take what they asked for
+	lowerBound := 0.8 * (float64(capacity) + refillRate*float64(duration))
+	fmt.Printf("Allowed by all leaves: %d, expected between %.0f and %.0f\n", total, lowerBound, upperBound)
+	if float64(total) > upperBound {
+		return fmt.Errorf("leaves were allowed %d requests, the root only had %.0f tokens", total, upperBound)
+	}
+	if float64(total) < lowerBound {
+		return fmt.Errorf("leaves were allowed only %d requests, the root had %.0f tokens", total, lowerBound)
+	}
+	return nil
+}
+
+func parseAllowed(output string) (int64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "Allowed: "); found {
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no result in output %q", output)
+}
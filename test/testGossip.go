@@ -0,0 +1,147 @@
+package test
+
+import (
+	"fmt"
+	"math"
+	"stepwell/gossip"
+	"stepwell/stepwellplus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lossRate of the simulated network in the gossip test
+const gossipLossRate = 0.2
+
+// how far the view of an instance may be off from the global value, relative to the global value
+const gossipTolerance = 0.15
+
+// handleGossipRequests sends requests to one instance at a fixed rate, using side channels to stop the routines
+func handleGossipRequests(node *gossip.Node, requestRate float64, stopChan <-chan struct{}, testRunning *atomic.Bool, sumIsAllowed *int64, lock *sync.Mutex) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	num_allowed := int64(0)
+	pending := 0.0
+	for {
+		select {
+		case <-stopChan: // Stop signal received
+			lock.Lock()
+			*sumIsAllowed += num_allowed
+			lock.Unlock()
+			return
+		case <-ticker.C:
+			pending += requestRate / 1000
+			for ; pending >= 1; pending-- {
+				allowed := node.IsAllowed(0, 1, time.Now())
+				if allowed && testRunning.Load() {
+					num_allowed++
+				}
+			}
+		}
+	}
+}
+
+// TestGossipConvergence runs numInstances gossiping instances on localhost, once over a perfect network and once
+// with gossipLossRate of the packets lost. Instance i asks for i+1 parts of twice the global rate, so every instance
+// should converge to i+1 parts of the global rate, and its view of the total demand should match the sum of the demands.
+func TestGossipConvergence(numInstances uint64, bucketType int, duration int, refillRateInt int, capacityInt int) error {
+	for _, lossRate := range []float64{0, gossipLossRate} {
+		if err := runGossip(numInstances, bucketType, duration, refillRateInt, capacityInt, lossRate); err != nil {
+			return fmt.Errorf("loss rate %.2f: %v", lossRate, err)
+		}
+	}
+	fmt.Println("Gossip test passed.")
+	return nil
+}
+
+func withinTolerance(actual float64, expected float64) bool {
+	return math.Abs(actual-expected) <= gossipTolerance*expected
+}
+
+func runGossip(numInstances uint64, bucketType int, duration int, refillRateInt int, capacityInt int, lossRate float64) error {
+	capacity := int64(capacityInt)
+	refillRate := float64(refillRateInt)
+	numSeconds := time.Duration(duration) * time.Second
+	interval := 50 * time.Millisecond
+
+	parts := float64(numInstances*(numInstances+1)) / 2
+	addrs := make([]string, numInstances)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", 17900+i)
+	}
+
+	nodes := make([]*gossip.Node, 0, numInstances)
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
+	for i := range addrs {
+		var peers []string
+		for j, addr := range addrs {
+			if j != i {
+				peers = append(peers, addr)
+			}
+		}
+		stepwellplus := stepwellplus.NewStepwellPlus(1, time.Second, time.Now(), bucketType, capacity, refillRate/float64(numInstances))
+		node, err := gossip.NewNode(gossip.Config{
+			Addr:             addrs[i],
+			Peers:            peers,
+			GlobalRefillRate: refillRate,
+			Interval:         interval,
+			MinShare:         0.1,
+			LossRate:         lossRate,
+		}, stepwellplus)
+		if err != nil {
+			return fmt.Errorf("failed to start instance %d: %v", i, err)
+		}
+		node.Start()
+		nodes = append(nodes, node)
+	}
+
+	var testRunning atomic.Bool
+	var lock sync.Mutex
+	totalAllowed := int64(0)
+	stopChans := make([]chan struct{}, numInstances)
+	for i, node := range nodes {
+		stopChans[i] = make(chan struct{})
+		requestRate := 2 * refillRate * float64(i+1) / parts
+		go handleGossipRequests(node, requestRate, stopChans[i], &testRunning, &totalAllowed, &lock)
+	}
+
+	// 40 rounds to converge before measuring
+	time.Sleep(40 * interval)
+	testRunning.Store(true)
+	time.Sleep(numSeconds)
+	testRunning.Store(false)
+
+	// the views are read while the load is still running, they drift apart once it stops
+	var failure error
+	globalDemand := 0.0
+	for _, node := range nodes {
+		globalDemand += node.GetDemand()
+	}
+	for i, node := range nodes {
+		expectedShare := refillRate * float64(i+1) / parts
+		rate := node.GetRefillRate()
+		view := node.GetTotalDemand()
+		fmt.Printf("Instance %d: expected rate %.2f actual rate %.2f, total demand %.2f seen as %.2f\n", i, expectedShare, rate, globalDemand, view)
+		if failure == nil && !withinTolerance(view, globalDemand) {
+			failure = fmt.Errorf("instance %d sees a total demand of %.2f instead of %.2f", i, view, globalDemand)
+		}
+		if failure == nil && !withinTolerance(rate, expectedShare) {
+			failure = fmt.Errorf("instance %d has a refill rate of %.2f instead of %.2f", i, rate, expectedShare)
+		}
+	}
+
+	for _, stopChan := range stopChans {
+		close(stopChan)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	expected_tokens := float64(numSeconds.Seconds()) * refillRate
+	lock.Lock()
+	fmt.Printf("Expected: %.2f Actual: %d\n", expected_tokens, totalAllowed)
+	lock.Unlock()
+	return failure
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"stepwell/httplimit"
+	"stepwell/keyed"
+	"stepwell/stepwell"
+	"strconv"
+	"time"
+)
+
+// expectHeader compares one response header with the expected value
+func expectHeader(response *http.Response, name string, expected string) error {
+	if value := response.Header.Get(name); value != expected {
+		return fmt.Errorf("%s is %q instead of %q", name, value, expected)
+	}
+	return nil
+}
+
+// TestHTTPLimit runs the middleware with httptest against a StepWell and a keyed limiter and checks
+// the status codes and RateLimit headers of every response
+func TestHTTPLimit() error {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+
+	// 3 tokens and one token per minute, so no token is refilled while the test runs
+	limiter := httplimit.NewStepWellLimiter(stepwell.NewStepwell(1, time.Now(), 4, 3, 1.0/60))
+	middleware := httplimit.NewMiddleware(ok, limiter, httplimit.KeyByIP)
+	for i := 0; i < 4; i++ {
+		recorder := httptest.NewRecorder()
+		middleware.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		response := recorder.Result()
+		if err := expectHeader(response, "RateLimit-Limit", "3"); err != nil {
+			return err
+		}
+		if i < 3 {
+			if response.StatusCode != http.StatusOK {
+				return fmt.Errorf("request %d got status %d instead of 200", i, response.StatusCode)
+			}
+			if err := expectHeader(response, "RateLimit-Remaining", strconv.Itoa(2-i)); err != nil {
+				return err
+			}
+			if err := expectHeader(response, "RateLimit-Reset", strconv.Itoa(60*(i+1))); err != nil {
+				return err
+			}
+			continue
+		}
+		if response.StatusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("request %d got status %d instead of 429", i, response.StatusCode)
+		}
+		if err := expectHeader(response, "RateLimit-Remaining", "0"); err != nil {
+			return err
+		}
+		if err := expectHeader(response, "Retry-After", "60"); err != nil {
+			return err
+		}
+	}
+
+	// every API key has its own bucket, requests without the key are charged to their IP
+	keyedLimiter := keyed.NewKeyedLimiter(keyed.Config{BucketType: 4, Capacity: 1, RefillRate: 1.0 / 60, NumCores: 1})
+	server := httptest.NewServer(httplimit.NewMiddleware(ok, httplimit.NewKeyedLimiter(keyedLimiter), httplimit.KeyByHeader("X-API-Key")))
+	defer server.Close()
+	for i, step := range []struct {
+		key    string
+		status int
+	}{
+		{"a", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+		{"b", http.StatusOK},
+		{"", http.StatusOK},
+		{"", http.StatusTooManyRequests},
+	} {
+		request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			return err
+		}
+		if step.key != "" {
+			request.Header.Set("X-API-Key", step.key)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if response.StatusCode != step.status {
+			return fmt.Errorf("keyed request %d got status %d instead of %d", i, response.StatusCode, step.status)
+		}
+	}
+	if keyedLimiter.Len() != 3 {
+		return errors.New("keyed limiter does not track exactly the keys a, b and the client IP")
+	}
+
+	fmt.Println("HTTP middleware test passed.")
+	return nil
+}
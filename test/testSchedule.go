@@ -0,0 +1,105 @@
+package test
+
+import (
+	"fmt"
+	"stepwell/schedule"
+	"sync"
+	"time"
+)
+
+// scheduleTarget records the values a scheduler sets
+type scheduleTarget struct {
+	refillRate float64
+	capacity   int64
+	sync.Mutex
+}
+
+func (target *scheduleTarget) SetRefillRate(refillRate float64) {
+	target.Lock()
+	defer target.Unlock()
+	target.refillRate = refillRate
+}
+
+func (target *scheduleTarget) SetCapacity(capacity int64) {
+	target.Lock()
+	defer target.Unlock()
+	target.capacity = capacity
+}
+
+func (target *scheduleTarget) get() (float64, int64) {
+	target.Lock()
+	defer target.Unlock()
+	return target.refillRate, target.capacity
+}
+
+type scheduleStep struct {
+	advance    time.Duration
+	at         string
+	refillRate float64
+	capacity   int64
+}
+
+// TestSchedule steps a scheduler through a day on a FakeClock and checks the values its target gets,
+// once with step and once with smooth transitions
+func TestSchedule() error {
+	start := time.Date(2024, 1, 1, 7, 59, 0, 0, time.UTC)
+	err := runSchedule("step", start, []scheduleStep{
+		// before the first point of the day the last point of yesterday is in effect
+		{0, "07:59", 1000, 2000},
+		{time.Minute, "08:00", 100, 200},
+		{10 * time.Hour, "18:00", 1000, 2000},
+		{14 * time.Hour, "08:00", 100, 200},
+	})
+	if err != nil {
+		return err
+	}
+	err = runSchedule("smooth", start.Add(time.Minute), []scheduleStep{
+		{0, "08:00", 100, 200},
+		{5 * time.Hour, "13:00", 550, 1100},
+		{5 * time.Hour, "18:00", 1000, 2000},
+		// halfway through the night back to 08:00
+		{7 * time.Hour, "01:00", 550, 1100},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Schedule test passed.")
+	return nil
+}
+
+// runSchedule advances the clock by every step and waits for the scheduler goroutine to apply its values.
+// Every step changes the values, so seeing them applied means the scheduler already waits for the next tick.
+func runSchedule(transition string, start time.Time, steps []scheduleStep) error {
+	plan, err := schedule.NewSchedule(schedule.Config{
+		Transition: transition,
+		Points: []schedule.Point{
+			{At: "08:00", RefillRate: 100, Capacity: 200},
+			{At: "18:00", RefillRate: 1000, Capacity: 2000},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	clock := schedule.NewFakeClock(start)
+	target := &scheduleTarget{}
+	scheduler := schedule.NewScheduler(plan, clock, target)
+	scheduler.Start()
+	defer scheduler.Stop()
+
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		deadline := time.Now().Add(time.Second)
+		for {
+			refillRate, capacity := target.get()
+			if refillRate == step.refillRate && capacity == step.capacity {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s schedule at %s set refill rate %v and capacity %d instead of %v and %d",
+					transition, step.at, refillRate, capacity, step.refillRate, step.capacity)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return nil
+}
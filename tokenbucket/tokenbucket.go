@@ -6,11 +6,68 @@ import (
 
 type TokenBucketInterface interface {
 	IsAllowed(amount int64, now time.Time) bool
+	// Grant as many tokens as available but at most max, returns the number of granted tokens
+	AllowUpTo(max int64, now time.Time) int64
+	// Give back tokens which were granted before but not used, the bucket never exceeds its capacity
+	ReturnTokens(amount int64)
 	GetCapacity() int64
 	GetTokens() int64
 	SetRefillRate(refillRate float64)
 }
 
+// CapacitySetter is implemented by the buckets whose capacity can change while they are in use.
+// Lowering the capacity drops the tokens above it.
+type CapacitySetter interface {
+	SetCapacity(capacity int64)
+}
+
+// TokensAtGetter is implemented by the buckets whose tokens depend on the time, GetTokensAt answers for the
+// clock of the caller instead of the wall clock
+type TokensAtGetter interface {
+	GetTokensAt(now time.Time) int64
+}
+
+// GetTokensAt returns the tokens of bucket at now, buckets which do not depend on the time answer with GetTokens
+func GetTokensAt(bucket TokenBucketInterface, now time.Time) int64 {
+	if getter, ok := bucket.(TokensAtGetter); ok {
+		return getter.GetTokensAt(now)
+	}
+	return bucket.GetTokens()
+}
+
+// AllowBetween grants between min and max tokens of bucket or nothing. A grant below min goes back right away,
+// so callers like a byte shaper are not handed a few tokens whenever the bucket just refilled.
+func AllowBetween(bucket TokenBucketInterface, min int64, max int64, now time.Time) int64 {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		return 0
+	}
+	granted := bucket.AllowUpTo(max, now)
+	if granted > 0 && granted < min {
+		ReturnTokensAt(bucket, granted, now)
+		return 0
+	}
+	return granted
+}
+
+// ReturnerAt is implemented by the buckets which need to know when returned tokens were charged,
+// e.g. a calendar quota must not give tokens of a window which has ended to the next one
+type ReturnerAt interface {
+	ReturnTokensAt(amount int64, chargedAt time.Time)
+}
+
+// ReturnTokensAt gives tokens charged at chargedAt back to bucket, buckets which do not care about the time
+// get them with ReturnTokens
+func ReturnTokensAt(bucket TokenBucketInterface, amount int64, chargedAt time.Time) {
+	if returner, ok := bucket.(ReturnerAt); ok {
+		returner.ReturnTokensAt(amount, chargedAt)
+		return
+	}
+	bucket.ReturnTokens(amount)
+}
+
 func NewTokenBucketByType(bucketType int, capacity int64, refillRate float64, now time.Time) TokenBucketInterface {
 	switch bucketType {
 	case 1:
@@ -23,6 +80,8 @@ func NewTokenBucketByType(bucketType int, capacity int64, refillRate float64, no
 		return NewTokenBucketHelia(capacity, refillRate, now)
 	case 5:
 		return NewTokenBucketAtomicStructs(capacity, refillRate, now)
+	case 6:
+		return NewTokenBucketSharded(capacity, refillRate, now)
 	default:
 		return NewTokenBucketTrivial(capacity, refillRate, now)
 	}
@@ -1,6 +1,7 @@
 package tokenbucket
 
 import (
+	"encoding/json"
 	"math"
 	"sync/atomic"
 	"time"
@@ -50,6 +51,16 @@ func (bucket *TokenBucketAtomicLoops) SetRefillRate(refillRate float64) {
 	bucket.refillRate = refillRate
 }
 
+func (bucket *TokenBucketAtomicLoops) SetCapacity(capacity int64) {
+	bucket.capacity = capacity
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.tokens)
+		if currentTokens <= capacity || atomic.CompareAndSwapInt64(&bucket.tokens, currentTokens, capacity) {
+			return
+		}
+	}
+}
+
 func (bucket *TokenBucketAtomicLoops) GetCapacity() int64 {
 	return bucket.capacity
 }
@@ -71,4 +82,77 @@ func (bucket *TokenBucketAtomicLoops) IsAllowed(amount int64, now time.Time) boo
 	}
 }
 
+func (bucket *TokenBucketAtomicLoops) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.refillTokens(now)
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.tokens)
+		granted := max
+		if currentTokens < granted {
+			granted = currentTokens
+		}
+		if granted <= 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&bucket.tokens, currentTokens, currentTokens-granted) {
+			return granted
+		}
+	}
+}
+
+func (bucket *TokenBucketAtomicLoops) ReturnTokens(amount int64) {
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.tokens)
+		newTokens := currentTokens + amount
+		if newTokens > bucket.capacity {
+			newTokens = bucket.capacity
+		}
+		if atomic.CompareAndSwapInt64(&bucket.tokens, currentTokens, newTokens) {
+			return
+		}
+	}
+}
+
+func (bucket *TokenBucketAtomicLoops) state() BucketState {
+	return BucketState{
+		Type:       2,
+		Capacity:   bucket.capacity,
+		RefillRate: bucket.refillRate,
+		Tokens:     atomic.LoadInt64(&bucket.tokens),
+		LastRefill: atomic.LoadInt64(&bucket.lastRefill),
+	}
+}
+
+func (bucket *TokenBucketAtomicLoops) restore(state BucketState) {
+	bucket.capacity = state.Capacity
+	bucket.refillRate = state.RefillRate
+	atomic.StoreInt64(&bucket.tokens, state.Tokens)
+	atomic.StoreInt64(&bucket.lastRefill, state.LastRefill)
+}
+
+func (bucket *TokenBucketAtomicLoops) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketAtomicLoops) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 2)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketAtomicLoops) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketAtomicLoops) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 2)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
 var _ TokenBucketInterface = (*TokenBucketAtomicLoops)(nil)
@@ -1,6 +1,7 @@
 package tokenbucket
 
 import (
+	"encoding/json"
 	"math"
 	"sync/atomic"
 	"time"
@@ -62,6 +63,21 @@ func (bucket *TokenBucketAtomicStructs) SetRefillRate(refillRate float64) {
 	bucket.refillRate = refillRate
 }
 
+func (bucket *TokenBucketAtomicStructs) SetCapacity(capacity int64) {
+	bucket.capacity = capacity
+	for {
+		lastContents := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&bucket.contents)))
+		contents := (*tokenBucketContents)(lastContents)
+		if contents.tokens <= capacity {
+			return
+		}
+		newStruct := tokenBucketContents{tokens: capacity, lastRefill: contents.lastRefill}
+		if atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&bucket.contents)), lastContents, unsafe.Pointer(&newStruct)) {
+			return
+		}
+	}
+}
+
 func (bucket *TokenBucketAtomicStructs) GetCapacity() int64 {
 	return bucket.capacity
 }
@@ -93,4 +109,90 @@ func (bucket *TokenBucketAtomicStructs) IsAllowed(amount int64, now time.Time) b
 	}
 }
 
+func (bucket *TokenBucketAtomicStructs) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.refillTokens(now)
+	for {
+		lastContents := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(
+			&bucket.contents)))
+		contents := (*tokenBucketContents)(lastContents)
+		granted := max
+		if contents.tokens < granted {
+			granted = contents.tokens
+		}
+		if granted <= 0 {
+			return 0
+		}
+		newStruct := tokenBucketContents{
+			tokens:     contents.tokens - granted,
+			lastRefill: contents.lastRefill,
+		}
+
+		if atomic.CompareAndSwapPointer(
+			(*unsafe.Pointer)(unsafe.Pointer(&bucket.contents)), lastContents,
+			unsafe.Pointer(&newStruct)) {
+			return granted
+		}
+	}
+}
+
+func (bucket *TokenBucketAtomicStructs) ReturnTokens(amount int64) {
+	for {
+		lastContents := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(
+			&bucket.contents)))
+		contents := (*tokenBucketContents)(lastContents)
+		newTokens := contents.tokens + amount
+		if newTokens > bucket.capacity {
+			newTokens = bucket.capacity
+		}
+		newStruct := tokenBucketContents{
+			tokens:     newTokens,
+			lastRefill: contents.lastRefill,
+		}
+
+		if atomic.CompareAndSwapPointer(
+			(*unsafe.Pointer)(unsafe.Pointer(&bucket.contents)), lastContents,
+			unsafe.Pointer(&newStruct)) {
+			return
+		}
+	}
+}
+
+func (bucket *TokenBucketAtomicStructs) state() BucketState {
+	contents := (*tokenBucketContents)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&bucket.contents))))
+	return BucketState{Type: 5, Capacity: bucket.capacity, RefillRate: bucket.refillRate, Tokens: contents.tokens, LastRefill: contents.lastRefill}
+}
+
+func (bucket *TokenBucketAtomicStructs) restore(state BucketState) {
+	bucket.capacity = state.Capacity
+	bucket.refillRate = state.RefillRate
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&bucket.contents)),
+		unsafe.Pointer(&tokenBucketContents{tokens: state.Tokens, lastRefill: state.LastRefill}))
+}
+
+func (bucket *TokenBucketAtomicStructs) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketAtomicStructs) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 5)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketAtomicStructs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketAtomicStructs) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 5)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
 var _ TokenBucketInterface = (*TokenBucketAtomicStructs)(nil)
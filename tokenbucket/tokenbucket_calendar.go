@@ -0,0 +1,260 @@
+//Quota which resets at calendar boundaries instead of refilling continuously, e.g. 1M requests per day starting at midnight in a given time zone
+
+package tokenbucket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+type Period int
+
+const (
+	Minute Period = iota
+	Hour
+	Day
+	Month
+)
+
+type TokenBucketCalendar struct {
+	quota    int64
+	used     int64
+	period   Period
+	location *time.Location
+	// current window as Unix timestamps in nanoseconds
+	windowStart int64
+	windowEnd   int64
+	sync.Mutex
+}
+
+// NewTokenBucketCalendar creates a quota whose windows start at the wall-clock boundaries of period in location
+func NewTokenBucketCalendar(quota int64, period Period, location *time.Location, now time.Time) *TokenBucketCalendar {
+	if location == nil {
+		location = time.UTC
+	}
+	bucket := &TokenBucketCalendar{
+		quota:    quota,
+		period:   period,
+		location: location,
+	}
+	bucket.startWindow(now)
+	return bucket
+}
+
+// window returns the boundaries of the window containing now. Days and months are built with time.Date,
+// so a day with a DST change is 23 or 25 hours long. Minutes and hours are computed from the wall clock
+// of now, which stays correct in the hour which repeats when the clocks are set back.
+func (bucket *TokenBucketCalendar) window(now time.Time) (time.Time, time.Time) {
+	local := now.In(bucket.location)
+	year, month, day := local.Date()
+	switch bucket.period {
+	case Minute:
+		start := local.Add(-time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+		return start, start.Add(time.Minute)
+	case Hour:
+		start := local.Add(-time.Duration(local.Minute())*time.Minute - time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+		return start, start.Add(time.Hour)
+	case Month:
+		return time.Date(year, month, 1, 0, 0, 0, 0, bucket.location), time.Date(year, month+1, 1, 0, 0, 0, 0, bucket.location)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, bucket.location), time.Date(year, month, day+1, 0, 0, 0, 0, bucket.location)
+	}
+}
+
+func (bucket *TokenBucketCalendar) startWindow(now time.Time) {
+	start, end := bucket.window(now)
+	bucket.windowStart = start.UnixNano()
+	bucket.windowEnd = end.UnixNano()
+	bucket.used = 0
+}
+
+// refillTokens resets the quota once now left the current window, the caller holds the lock
+func (bucket *TokenBucketCalendar) refillTokens(now time.Time) {
+	if now.UnixNano() >= bucket.windowEnd {
+		bucket.startWindow(now)
+	}
+}
+
+// A quota does not refill, SetRefillRate leaves it alone so rate controllers like a scheduler or an AIMD
+// limiter can not change a billing quota by accident. The quota only changes with SetQuota.
+func (bucket *TokenBucketCalendar) SetRefillRate(refillRate float64) {
+}
+
+// SetQuota changes the quota of the current and all following windows, tokens already used in the current window stay used
+func (bucket *TokenBucketCalendar) SetQuota(quota int64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.quota = quota
+}
+
+func (bucket *TokenBucketCalendar) GetCapacity() int64 {
+	bucket.Lock()
+	defer bucket.Unlock()
+	return bucket.quota
+}
+
+func (bucket *TokenBucketCalendar) GetTokens() int64 {
+	bucket.Lock()
+	defer bucket.Unlock()
+	if bucket.used > bucket.quota {
+		return 0
+	}
+	return bucket.quota - bucket.used
+}
+
+// GetWindowEnd returns when the current window ends and the quota is available again
+func (bucket *TokenBucketCalendar) GetWindowEnd() time.Time {
+	bucket.Lock()
+	defer bucket.Unlock()
+	return time.Unix(0, bucket.windowEnd).In(bucket.location)
+}
+
+func (bucket *TokenBucketCalendar) IsAllowed(amount int64, now time.Time) bool {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.refillTokens(now)
+	if bucket.quota-bucket.used >= amount {
+		bucket.used += amount
+		return true
+	}
+	return false
+}
+
+func (bucket *TokenBucketCalendar) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.refillTokens(now)
+	granted := max
+	if bucket.quota-bucket.used < granted {
+		granted = bucket.quota - bucket.used
+	}
+	if granted <= 0 {
+		return 0
+	}
+	bucket.used += granted
+	return granted
+}
+
+// ReturnTokens gives the tokens back to the current window, callers which know when the tokens were charged
+// use ReturnTokensAt instead
+func (bucket *TokenBucketCalendar) ReturnTokens(amount int64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.returnTokens(amount)
+}
+
+// ReturnTokensAt ignores tokens which were charged in a window which has already ended,
+// the window they were charged in is gone and the current window never paid for them
+func (bucket *TokenBucketCalendar) ReturnTokensAt(amount int64, chargedAt time.Time) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	if chargedAt.UnixNano() < bucket.windowStart || chargedAt.UnixNano() >= bucket.windowEnd {
+		return
+	}
+	bucket.returnTokens(amount)
+}
+
+func (bucket *TokenBucketCalendar) returnTokens(amount int64) {
+	bucket.used -= amount
+	if bucket.used < 0 {
+		bucket.used = 0
+	}
+}
+
+// calendarState is the snapshot of a calendar quota. The window is stored as well, a quota restored within
+// the same window keeps what was used and one restored after the window ended starts a new window on its next use.
+type calendarState struct {
+	Type        int    `json:"type"`
+	Quota       int64  `json:"quota"`
+	Used        int64  `json:"used"`
+	Period      Period `json:"period"`
+	Location    string `json:"location"`
+	WindowStart int64  `json:"windowStart"`
+	WindowEnd   int64  `json:"windowEnd"`
+}
+
+const (
+	calendarType = 7
+	// version and type byte followed by five 8 byte fields, the name of the location takes the rest
+	calendarStateSize = 2 + 5*8
+)
+
+func (bucket *TokenBucketCalendar) state() calendarState {
+	bucket.Lock()
+	defer bucket.Unlock()
+	return calendarState{
+		Type:        calendarType,
+		Quota:       bucket.quota,
+		Used:        bucket.used,
+		Period:      bucket.period,
+		Location:    bucket.location.String(),
+		WindowStart: bucket.windowStart,
+		WindowEnd:   bucket.windowEnd,
+	}
+}
+
+func (bucket *TokenBucketCalendar) restore(state calendarState) error {
+	if state.Type != calendarType {
+		return errors.New("snapshot belongs to a different bucket type")
+	}
+	location, err := time.LoadLocation(state.Location)
+	if err != nil {
+		return err
+	}
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.quota = state.Quota
+	bucket.used = state.Used
+	bucket.period = state.Period
+	bucket.location = location
+	bucket.windowStart = state.WindowStart
+	bucket.windowEnd = state.WindowEnd
+	return nil
+}
+
+func (bucket *TokenBucketCalendar) MarshalBinary() ([]byte, error) {
+	state := bucket.state()
+	data := make([]byte, 0, calendarStateSize+len(state.Location))
+	data = append(data, snapshotVersion, calendarType)
+	data = binary.BigEndian.AppendUint64(data, uint64(state.Quota))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.Used))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.Period))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.WindowStart))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.WindowEnd))
+	return append(data, state.Location...), nil
+}
+
+func (bucket *TokenBucketCalendar) UnmarshalBinary(data []byte) error {
+	if len(data) < calendarStateSize {
+		return errors.New("invalid bucket snapshot length")
+	}
+	if data[0] != snapshotVersion {
+		return errors.New("unknown snapshot version")
+	}
+	return bucket.restore(calendarState{
+		Type:        int(data[1]),
+		Quota:       int64(binary.BigEndian.Uint64(data[2:])),
+		Used:        int64(binary.BigEndian.Uint64(data[10:])),
+		Period:      Period(binary.BigEndian.Uint64(data[18:])),
+		WindowStart: int64(binary.BigEndian.Uint64(data[26:])),
+		WindowEnd:   int64(binary.BigEndian.Uint64(data[34:])),
+		Location:    string(data[calendarStateSize:]),
+	})
+}
+
+func (bucket *TokenBucketCalendar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketCalendar) UnmarshalJSON(data []byte) error {
+	var state calendarState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	return bucket.restore(state)
+}
+
+var _ TokenBucketInterface = (*TokenBucketCalendar)(nil)
@@ -0,0 +1,200 @@
+//Several limits on the same requests, e.g. a token bucket with 10/s and a calendar quota with 1M/day.
+//A request is only allowed if every bucket allows it, either all buckets are charged or none.
+
+package tokenbucket
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type TokenBucketComposite struct {
+	buckets []TokenBucketInterface
+}
+
+func NewTokenBucketComposite(buckets ...TokenBucketInterface) *TokenBucketComposite {
+	return &TokenBucketComposite{buckets: buckets}
+}
+
+func (bucket *TokenBucketComposite) IsAllowed(amount int64, now time.Time) bool {
+	for i, inner := range bucket.buckets {
+		if !inner.IsAllowed(amount, now) {
+			for _, charged := range bucket.buckets[:i] {
+				ReturnTokensAt(charged, amount, now)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// AllowUpTo asks every bucket for what the buckets before it granted and returns the surplus of the earlier ones
+func (bucket *TokenBucketComposite) AllowUpTo(max int64, now time.Time) int64 {
+	grants := make([]int64, len(bucket.buckets))
+	granted := max
+	for i, inner := range bucket.buckets {
+		grants[i] = inner.AllowUpTo(granted, now)
+		granted = grants[i]
+		if granted <= 0 {
+			break
+		}
+	}
+	if granted < 0 {
+		granted = 0
+	}
+	for i, inner := range bucket.buckets {
+		if grants[i] > granted {
+			ReturnTokensAt(inner, grants[i]-granted, now)
+		}
+	}
+	return granted
+}
+
+func (bucket *TokenBucketComposite) ReturnTokens(amount int64) {
+	for _, inner := range bucket.buckets {
+		inner.ReturnTokens(amount)
+	}
+}
+
+func (bucket *TokenBucketComposite) ReturnTokensAt(amount int64, chargedAt time.Time) {
+	for _, inner := range bucket.buckets {
+		ReturnTokensAt(inner, amount, chargedAt)
+	}
+}
+
+// SetRefillRate passes the rate to every bucket except the calendar quotas, they only change with SetQuota
+func (bucket *TokenBucketComposite) SetRefillRate(refillRate float64) {
+	for _, inner := range bucket.buckets {
+		if _, ok := inner.(*TokenBucketCalendar); ok {
+			continue
+		}
+		inner.SetRefillRate(refillRate)
+	}
+}
+
+// SetCapacity passes the capacity to every bucket which supports it, a calendar quota keeps its quota
+func (bucket *TokenBucketComposite) SetCapacity(capacity int64) {
+	for _, inner := range bucket.buckets {
+		if setter, ok := inner.(CapacitySetter); ok {
+			setter.SetCapacity(capacity)
+		}
+	}
+}
+
+// GetCapacity returns the smallest capacity of all buckets
+func (bucket *TokenBucketComposite) GetCapacity() int64 {
+	return bucket.min(TokenBucketInterface.GetCapacity)
+}
+
+// GetTokens returns the smallest number of tokens of all buckets
+func (bucket *TokenBucketComposite) GetTokens() int64 {
+	return bucket.min(TokenBucketInterface.GetTokens)
+}
+
+func (bucket *TokenBucketComposite) min(get func(TokenBucketInterface) int64) int64 {
+	if len(bucket.buckets) == 0 {
+		return 0
+	}
+	result := get(bucket.buckets[0])
+	for _, inner := range bucket.buckets[1:] {
+		if value := get(inner); value < result {
+			result = value
+		}
+	}
+	return result
+}
+
+// compositeState is the JSON snapshot of a composite bucket, every inner bucket keeps its own snapshot.
+// A quota which several composites share is restored as a copy per composite.
+type compositeState struct {
+	Type    int               `json:"type"`
+	Buckets []json.RawMessage `json:"buckets"`
+}
+
+const compositeType = 8
+
+func (bucket *TokenBucketComposite) MarshalBinary() ([]byte, error) {
+	data := []byte{snapshotVersion, compositeType}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(bucket.buckets)))
+	for _, inner := range bucket.buckets {
+		innerData, err := MarshalTokenBucket(inner)
+		if err != nil {
+			return nil, err
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(innerData)))
+		data = append(data, innerData...)
+	}
+	return data, nil
+}
+
+func (bucket *TokenBucketComposite) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 {
+		return errors.New("invalid bucket snapshot length")
+	}
+	if data[0] != snapshotVersion {
+		return errors.New("unknown snapshot version")
+	}
+	if data[1] != compositeType {
+		return errors.New("snapshot belongs to a different bucket type")
+	}
+	count := binary.BigEndian.Uint32(data[2:])
+	rest := data[6:]
+	// every inner bucket needs at least its length prefix
+	if uint64(count) > uint64(len(rest))/4 {
+		return errors.New("invalid bucket snapshot length")
+	}
+	buckets := make([]TokenBucketInterface, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(rest) < 4 {
+			return errors.New("invalid bucket snapshot length")
+		}
+		length := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)) < 4+uint64(length) {
+			return errors.New("invalid bucket snapshot length")
+		}
+		inner, err := UnmarshalTokenBucket(rest[4 : 4+length])
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, inner)
+		rest = rest[4+length:]
+	}
+	bucket.buckets = buckets
+	return nil
+}
+
+func (bucket *TokenBucketComposite) MarshalJSON() ([]byte, error) {
+	state := compositeState{Type: compositeType}
+	for _, inner := range bucket.buckets {
+		innerData, err := MarshalTokenBucketJSON(inner)
+		if err != nil {
+			return nil, err
+		}
+		state.Buckets = append(state.Buckets, innerData)
+	}
+	return json.Marshal(state)
+}
+
+func (bucket *TokenBucketComposite) UnmarshalJSON(data []byte) error {
+	var state compositeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Type != compositeType {
+		return errors.New("snapshot belongs to a different bucket type")
+	}
+	buckets := make([]TokenBucketInterface, 0, len(state.Buckets))
+	for _, innerData := range state.Buckets {
+		inner, err := UnmarshalTokenBucketJSON(innerData)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, inner)
+	}
+	bucket.buckets = buckets
+	return nil
+}
+
+var _ TokenBucketInterface = (*TokenBucketComposite)(nil)
@@ -3,6 +3,8 @@
 package tokenbucket
 
 import (
+	"encoding/json"
+	"math"
 	"sync/atomic"
 	"time"
 )
@@ -26,20 +28,39 @@ func (bucket *TokenBucketHelia) SetRefillRate(refillRate float64) {
 	bucket.refillRateInverse = 1 / refillRate
 }
 
+// Tokens which are used up beyond the new capacity keep the timestamp ahead of now, the bucket refills them first
+func (bucket *TokenBucketHelia) SetCapacity(capacity int64) {
+	bucket.capacity = capacity
+}
+
 func (bucket *TokenBucketHelia) GetCapacity() int64 {
 	return bucket.capacity
 }
 
+// GetTimestamp returns the theoretical arrival time of GCRA, it lies ahead of now while tokens are used up
+func (bucket *TokenBucketHelia) GetTimestamp() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&bucket.timestamp))
+}
+
+// GetTokens returns the tokens which are available right now, like all other bucket types
 func (bucket *TokenBucketHelia) GetTokens() int64 {
-	now := time.Now()
+	return bucket.GetTokensAt(time.Now())
+}
+
+// The timestamp runs ahead of now by the time it takes to refill the used up tokens
+func (bucket *TokenBucketHelia) GetTokensAt(now time.Time) int64 {
 	nowUnix := now.UnixNano()
 	latestTimestamp := atomic.LoadInt64(&bucket.timestamp)
 	if nowUnix >= latestTimestamp {
-		return 0
+		return bucket.capacity
 	} else {
 		duration := time.Duration(latestTimestamp - nowUnix)
 		durationInSeconds := float64(duration) / float64(time.Second)
-		return int64(durationInSeconds / bucket.refillRateInverse)
+		used := int64(math.Ceil(durationInSeconds / bucket.refillRateInverse))
+		if used > bucket.capacity {
+			return 0
+		}
+		return bucket.capacity - used
 	}
 }
 
@@ -69,4 +90,82 @@ func (bucket *TokenBucketHelia) IsAllowed(amount int64, now time.Time) bool {
 	}
 }
 
+// The timestamp may lie at most T in the future, every granted token moves it by one token time
+func (bucket *TokenBucketHelia) AllowUpTo(max int64, now time.Time) int64 {
+	T := time.Duration(float64(bucket.capacity) * bucket.refillRateInverse * float64(time.Second))
+	tokenTime := bucket.refillRateInverse * float64(time.Second)
+
+	nowUnix := now.UnixNano()
+	for {
+		latestTimestamp := atomic.LoadInt64(&bucket.timestamp)
+		base := latestTimestamp
+		if nowUnix > latestTimestamp {
+			base = nowUnix
+		}
+
+		available := int64(float64(nowUnix+int64(T)-base) / tokenTime)
+		granted := max
+		if available < granted {
+			granted = available
+		}
+		if granted <= 0 {
+			return 0
+		}
+
+		newTimestamp := base + int64(time.Duration(float64(granted)*tokenTime))
+		if atomic.CompareAndSwapInt64(&bucket.timestamp, latestTimestamp, newTimestamp) {
+			return granted
+		}
+	}
+}
+
+// Returning tokens moves the timestamp back, a timestamp in the past already means a full bucket
+func (bucket *TokenBucketHelia) ReturnTokens(amount int64) {
+	packetTime := time.Duration(float64(amount) * bucket.refillRateInverse * float64(time.Second))
+	atomic.AddInt64(&bucket.timestamp, -int64(packetTime))
+}
+
+// The timestamp alone is the state of the bucket, Tokens is only informational
+func (bucket *TokenBucketHelia) state() BucketState {
+	return BucketState{
+		Type:       4,
+		Capacity:   bucket.capacity,
+		RefillRate: 1 / bucket.refillRateInverse,
+		Tokens:     bucket.GetTokens(),
+		LastRefill: atomic.LoadInt64(&bucket.timestamp),
+	}
+}
+
+func (bucket *TokenBucketHelia) restore(state BucketState) {
+	bucket.capacity = state.Capacity
+	bucket.refillRateInverse = 1 / state.RefillRate
+	atomic.StoreInt64(&bucket.timestamp, state.LastRefill)
+}
+
+func (bucket *TokenBucketHelia) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketHelia) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 4)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketHelia) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketHelia) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 4)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
 var _ TokenBucketInterface = (*TokenBucketHelia)(nil)
@@ -4,6 +4,7 @@
 package tokenbucket
 
 import (
+	"encoding/json"
 	"math"
 	"stepwell/extensions"
 	"sync"
@@ -51,6 +52,15 @@ func (bucket *TokenBucketLock) SetRefillRate(refillRate float64) {
 	bucket.refillRate = refillRate
 }
 
+func (bucket *TokenBucketLock) SetCapacity(capacity int64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.capacity = capacity
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+}
+
 func (bucket *TokenBucketLock) GetCapacity() int64 {
 	return bucket.capacity
 }
@@ -72,4 +82,71 @@ func (bucket *TokenBucketLock) IsAllowed(amount int64, now time.Time) bool {
 	return false
 }
 
+func (bucket *TokenBucketLock) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.refillTokens(now)
+	granted := max
+	if bucket.tokens < granted {
+		granted = bucket.tokens
+	}
+	if granted <= 0 {
+		return 0
+	}
+	extensions.ShortWait()
+	bucket.tokens -= granted
+	return granted
+}
+
+func (bucket *TokenBucketLock) ReturnTokens(amount int64) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	newTokens := bucket.tokens + amount
+	if newTokens > bucket.capacity {
+		newTokens = bucket.capacity
+	}
+	bucket.tokens = newTokens
+}
+
+func (bucket *TokenBucketLock) state() BucketState {
+	bucket.Lock()
+	defer bucket.Unlock()
+	return BucketState{Type: 3, Capacity: bucket.capacity, RefillRate: bucket.refillRate, Tokens: bucket.tokens, LastRefill: bucket.lastRefill}
+}
+
+func (bucket *TokenBucketLock) restore(state BucketState) {
+	bucket.Lock()
+	defer bucket.Unlock()
+	bucket.capacity = state.Capacity
+	bucket.refillRate = state.RefillRate
+	bucket.tokens = state.Tokens
+	bucket.lastRefill = state.LastRefill
+}
+
+func (bucket *TokenBucketLock) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketLock) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 3)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketLock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketLock) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 3)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
 var _ TokenBucketInterface = (*TokenBucketLock)(nil)
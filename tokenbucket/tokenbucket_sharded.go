@@ -0,0 +1,279 @@
+package tokenbucket
+
+import (
+	"encoding/json"
+	"math"
+	"runtime"
+	"stepwell/extensions"
+	"sync/atomic"
+	"time"
+)
+
+// pad every shard to its own cache line so cores do not invalidate each other
+type tokenBucketShard struct {
+	tokens int64
+	_      [56]byte
+}
+
+// TokenBucketSharded splits its tokens between a global pool and per-CPU shards. Requests are served
+// from the shard of their extensions.ShardHint and only touch the global pool when their shard runs dry,
+// which keeps the hot path on a core-local word like StepWell without walking a tree.
+// Between two reconciliations the shards can hold at most numShards*batchSize tokens on top of
+// the global pool, which bounds how far the bucket can exceed its capacity.
+type TokenBucketSharded struct {
+	capacity   int64
+	refillRate float64
+	// tokens which are not handed out to a shard yet
+	global     int64
+	lastRefill int64
+	shards     []tokenBucketShard
+	// how many tokens a shard takes from the global pool at once
+	batchSize int64
+	// Store as Unix timestamps/nanoseconds to be able to use atomic operations
+	reconcileInterval int64
+	lastReconcile     int64
+	reconciling       int32
+}
+
+func NewTokenBucketSharded(capacity int64, refillRate float64, lastRefill time.Time) *TokenBucketSharded {
+	numShards := runtime.NumCPU()
+	batchSize := capacity / int64(4*numShards)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return NewTokenBucketShardedWithConfig(capacity, refillRate, lastRefill, numShards, batchSize, 10*time.Millisecond)
+}
+
+func NewTokenBucketShardedWithConfig(capacity int64, refillRate float64, lastRefill time.Time, numShards int, batchSize int64, reconcileInterval time.Duration) *TokenBucketSharded {
+	if numShards <= 0 {
+		numShards = 1
+	}
+	return &TokenBucketSharded{
+		//total capacity of tokens to give out
+		capacity: capacity,
+		//how many new tokens per second are made available
+		refillRate: refillRate,
+		//all tokens start in the global pool, shards fetch them on demand
+		global:            capacity,
+		lastRefill:        lastRefill.UnixNano(),
+		shards:            make([]tokenBucketShard, numShards),
+		batchSize:         batchSize,
+		reconcileInterval: int64(reconcileInterval),
+		lastReconcile:     lastRefill.UnixNano(),
+	}
+}
+
+func (bucket *TokenBucketSharded) refillTokens(now time.Time) {
+	lastRefillUnixNano := atomic.LoadInt64(&bucket.lastRefill)
+	duration := now.UnixNano() - lastRefillUnixNano
+	tokensToAdd := int64(math.Floor(float64(bucket.refillRate) / 1_000_000_000 * float64(duration)))
+
+	// only the caller which moves the timestamp forward adds the tokens
+	if tokensToAdd > 0 && atomic.CompareAndSwapInt64(&bucket.lastRefill, lastRefillUnixNano, now.UnixNano()) {
+		bucket.addGlobal(tokensToAdd)
+	}
+}
+
+func (bucket *TokenBucketSharded) addGlobal(tokensToAdd int64) {
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.global)
+		newTokens := currentTokens + tokensToAdd
+		if newTokens > bucket.capacity {
+			newTokens = bucket.capacity
+		}
+		if atomic.CompareAndSwapInt64(&bucket.global, currentTokens, newTokens) {
+			return
+		}
+	}
+}
+
+// takeGlobal removes up to amount tokens from the global pool and returns how many it got
+func (bucket *TokenBucketSharded) takeGlobal(amount int64) int64 {
+	for {
+		currentTokens := atomic.LoadInt64(&bucket.global)
+		if currentTokens <= 0 {
+			return 0
+		}
+		taken := amount
+		if currentTokens < taken {
+			taken = currentTokens
+		}
+		if atomic.CompareAndSwapInt64(&bucket.global, currentTokens, currentTokens-taken) {
+			return taken
+		}
+	}
+}
+
+// reconcile moves the tokens parked in the shards back to the global pool and caps it at capacity.
+// Only one caller walks the shards at a time, everyone else returns right away.
+func (bucket *TokenBucketSharded) reconcile() {
+	if !atomic.CompareAndSwapInt32(&bucket.reconciling, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&bucket.reconciling, 0)
+	for i := range bucket.shards {
+		tokens := atomic.SwapInt64(&bucket.shards[i].tokens, 0)
+		if tokens > 0 {
+			bucket.addGlobal(tokens)
+		}
+	}
+}
+
+func (bucket *TokenBucketSharded) reconcileIfDue(now time.Time) {
+	lastReconcile := atomic.LoadInt64(&bucket.lastReconcile)
+	if now.UnixNano()-lastReconcile < bucket.reconcileInterval {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&bucket.lastReconcile, lastReconcile, now.UnixNano()) {
+		bucket.reconcile()
+	}
+}
+
+func (bucket *TokenBucketSharded) takeShard(shard *tokenBucketShard, amount int64) bool {
+	for {
+		currentTokens := atomic.LoadInt64(&shard.tokens)
+		if currentTokens < amount {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&shard.tokens, currentTokens, currentTokens-amount) {
+			return true
+		}
+	}
+}
+
+func (bucket *TokenBucketSharded) SetRefillRate(refillRate float64) {
+	bucket.refillRate = refillRate
+}
+
+// The tokens parked in the shards go back to the global pool, which is then capped at the new capacity
+func (bucket *TokenBucketSharded) SetCapacity(capacity int64) {
+	bucket.capacity = capacity
+	bucket.reconcile()
+	bucket.addGlobal(0)
+}
+
+func (bucket *TokenBucketSharded) GetCapacity() int64 {
+	return bucket.capacity
+}
+
+func (bucket *TokenBucketSharded) GetTokens() int64 {
+	tokens := atomic.LoadInt64(&bucket.global)
+	for i := range bucket.shards {
+		tokens += atomic.LoadInt64(&bucket.shards[i].tokens)
+	}
+	return tokens
+}
+
+func (bucket *TokenBucketSharded) IsAllowed(amount int64, now time.Time) bool {
+	bucket.refillTokens(now)
+	bucket.reconcileIfDue(now)
+
+	shard := &bucket.shards[extensions.ShardHint()%len(bucket.shards)]
+	if bucket.takeShard(shard, amount) {
+		return true
+	}
+
+	// shard exhausted: fetch a new batch from the global pool
+	taken := bucket.takeGlobal(amount + bucket.batchSize)
+	if taken > 0 {
+		atomic.AddInt64(&shard.tokens, taken)
+		if bucket.takeShard(shard, amount) {
+			return true
+		}
+	}
+
+	// the global pool is empty as well, collect what the other shards still hold and try one last time
+	bucket.reconcile()
+	taken = bucket.takeGlobal(amount)
+	if taken == amount {
+		return true
+	}
+	bucket.addGlobal(taken)
+	return false
+}
+
+func (bucket *TokenBucketSharded) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.refillTokens(now)
+	bucket.reconcileIfDue(now)
+
+	shard := &bucket.shards[extensions.ShardHint()%len(bucket.shards)]
+	granted := int64(0)
+	for {
+		currentTokens := atomic.LoadInt64(&shard.tokens)
+		granted = max
+		if currentTokens < granted {
+			granted = currentTokens
+		}
+		if granted <= 0 {
+			granted = 0
+			break
+		}
+		if atomic.CompareAndSwapInt64(&shard.tokens, currentTokens, currentTokens-granted) {
+			break
+		}
+	}
+
+	// serve the rest straight from the global pool and park a new batch in the shard
+	if granted < max {
+		granted += bucket.takeGlobal(max - granted)
+		atomic.AddInt64(&shard.tokens, bucket.takeGlobal(bucket.batchSize))
+	}
+	return granted
+}
+
+func (bucket *TokenBucketSharded) ReturnTokens(amount int64) {
+	bucket.addGlobal(amount)
+}
+
+// The snapshot only knows the sum of all tokens, they are restored into the global pool
+func (bucket *TokenBucketSharded) state() BucketState {
+	return BucketState{
+		Type:       6,
+		Capacity:   bucket.capacity,
+		RefillRate: bucket.refillRate,
+		Tokens:     bucket.GetTokens(),
+		LastRefill: atomic.LoadInt64(&bucket.lastRefill),
+	}
+}
+
+func (bucket *TokenBucketSharded) restore(state BucketState) {
+	if len(bucket.shards) == 0 {
+		*bucket = *NewTokenBucketSharded(state.Capacity, state.RefillRate, time.Unix(0, state.LastRefill))
+	}
+	bucket.capacity = state.Capacity
+	bucket.refillRate = state.RefillRate
+	for i := range bucket.shards {
+		atomic.StoreInt64(&bucket.shards[i].tokens, 0)
+	}
+	atomic.StoreInt64(&bucket.global, state.Tokens)
+	atomic.StoreInt64(&bucket.lastRefill, state.LastRefill)
+	atomic.StoreInt64(&bucket.lastReconcile, state.LastRefill)
+}
+
+func (bucket *TokenBucketSharded) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketSharded) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 6)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketSharded) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketSharded) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 6)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+var _ TokenBucketInterface = (*TokenBucketSharded)(nil)
@@ -0,0 +1,148 @@
+package tokenbucket
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+// BucketState is the snapshot of a bucket which all bucket types share. The bucket type is the same number
+// NewTokenBucketByType takes. LastRefill is a Unix timestamp in nanoseconds, for the timestamp token bucket
+// it holds its timestamp. Since the time keeps running while a process is down, a restored bucket refills
+// exactly the tokens it would have refilled without the restart.
+type BucketState struct {
+	Type       int     `json:"type"`
+	Capacity   int64   `json:"capacity"`
+	RefillRate float64 `json:"refillRate"`
+	Tokens     int64   `json:"tokens"`
+	LastRefill int64   `json:"lastRefill"`
+}
+
+const (
+	snapshotVersion = 1
+	// version and type byte followed by four 8 byte fields
+	bucketStateSize = 2 + 4*8
+)
+
+var errUnsupported = errors.New("bucket type does not support snapshots")
+
+func (state BucketState) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, bucketStateSize)
+	data = append(data, snapshotVersion, byte(state.Type))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.Capacity))
+	data = binary.BigEndian.AppendUint64(data, math.Float64bits(state.RefillRate))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.Tokens))
+	data = binary.BigEndian.AppendUint64(data, uint64(state.LastRefill))
+	return data, nil
+}
+
+func (state *BucketState) UnmarshalBinary(data []byte) error {
+	if len(data) != bucketStateSize {
+		return errors.New("invalid bucket snapshot length")
+	}
+	if data[0] != snapshotVersion {
+		return errors.New("unknown snapshot version")
+	}
+	state.Type = int(data[1])
+	state.Capacity = int64(binary.BigEndian.Uint64(data[2:]))
+	state.RefillRate = math.Float64frombits(binary.BigEndian.Uint64(data[10:]))
+	state.Tokens = int64(binary.BigEndian.Uint64(data[18:]))
+	state.LastRefill = int64(binary.BigEndian.Uint64(data[26:]))
+	return nil
+}
+
+func decodeState(data []byte, bucketType int) (BucketState, error) {
+	var state BucketState
+	if err := state.UnmarshalBinary(data); err != nil {
+		return state, err
+	}
+	if state.Type != bucketType {
+		return state, errors.New("snapshot belongs to a different bucket type")
+	}
+	return state, nil
+}
+
+func decodeStateJSON(data []byte, bucketType int) (BucketState, error) {
+	var state BucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.Type != bucketType {
+		return state, errors.New("snapshot belongs to a different bucket type")
+	}
+	return state, nil
+}
+
+// newTokenBucketOfType creates an empty bucket for the snapshot types which do not use BucketState,
+// nil for all others
+func newTokenBucketOfType(bucketType int) TokenBucketInterface {
+	switch bucketType {
+	case calendarType:
+		return &TokenBucketCalendar{}
+	case compositeType:
+		return &TokenBucketComposite{}
+	default:
+		return nil
+	}
+}
+
+// newTokenBucketFromState creates an empty bucket of the snapshotted type which the snapshot is then restored into
+func newTokenBucketFromState(state BucketState) (TokenBucketInterface, error) {
+	if state.Type < 1 || state.Type > 6 {
+		return nil, errUnsupported
+	}
+	return NewTokenBucketByType(state.Type, state.Capacity, state.RefillRate, time.Unix(0, state.LastRefill)), nil
+}
+
+// MarshalTokenBucket snapshots any bucket which supports it
+func MarshalTokenBucket(bucket TokenBucketInterface) ([]byte, error) {
+	marshaler, ok := bucket.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errUnsupported
+	}
+	return marshaler.MarshalBinary()
+}
+
+// UnmarshalTokenBucket creates a bucket of the type stored in the snapshot with the snapshotted state
+func UnmarshalTokenBucket(data []byte) (TokenBucketInterface, error) {
+	if len(data) >= 2 {
+		if bucket := newTokenBucketOfType(int(data[1])); bucket != nil {
+			return bucket, bucket.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+		}
+	}
+	var state BucketState
+	if err := state.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	bucket, err := newTokenBucketFromState(state)
+	if err != nil {
+		return nil, err
+	}
+	return bucket, bucket.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+}
+
+func MarshalTokenBucketJSON(bucket TokenBucketInterface) ([]byte, error) {
+	marshaler, ok := bucket.(json.Marshaler)
+	if !ok {
+		return nil, errUnsupported
+	}
+	return marshaler.MarshalJSON()
+}
+
+func UnmarshalTokenBucketJSON(data []byte) (TokenBucketInterface, error) {
+	var state BucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if bucket := newTokenBucketOfType(state.Type); bucket != nil {
+		return bucket, bucket.(json.Unmarshaler).UnmarshalJSON(data)
+	}
+	bucket, err := newTokenBucketFromState(state)
+	if err != nil {
+		return nil, err
+	}
+	return bucket, bucket.(json.Unmarshaler).UnmarshalJSON(data)
+}
@@ -4,6 +4,7 @@
 package tokenbucket
 
 import (
+	"encoding/json"
 	"math"
 	"stepwell/extensions"
 	"time"
@@ -48,6 +49,13 @@ func (bucket *TokenBucketTrivial) SetRefillRate(refillRate float64) {
 	bucket.refillRate = refillRate
 }
 
+func (bucket *TokenBucketTrivial) SetCapacity(capacity int64) {
+	bucket.capacity = capacity
+	if bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+}
+
 func (bucket *TokenBucketTrivial) GetCapacity() int64 {
 	return bucket.capacity
 }
@@ -67,4 +75,64 @@ func (bucket *TokenBucketTrivial) IsAllowed(amount int64, now time.Time) bool {
 	return false
 }
 
+func (bucket *TokenBucketTrivial) AllowUpTo(max int64, now time.Time) int64 {
+	bucket.refillTokens(now)
+	granted := max
+	if bucket.tokens < granted {
+		granted = bucket.tokens
+	}
+	if granted <= 0 {
+		return 0
+	}
+	//Wait a few nanoseconds to show concurrency effect
+	extensions.ShortWait()
+	bucket.tokens -= granted
+	return granted
+}
+
+func (bucket *TokenBucketTrivial) ReturnTokens(amount int64) {
+	newTokens := bucket.tokens + amount
+	if newTokens > bucket.capacity {
+		newTokens = bucket.capacity
+	}
+	bucket.tokens = newTokens
+}
+
+func (bucket *TokenBucketTrivial) state() BucketState {
+	return BucketState{Type: 1, Capacity: bucket.capacity, RefillRate: bucket.refillRate, Tokens: bucket.tokens, LastRefill: bucket.lastRefill}
+}
+
+func (bucket *TokenBucketTrivial) restore(state BucketState) {
+	bucket.capacity = state.Capacity
+	bucket.refillRate = state.RefillRate
+	bucket.tokens = state.Tokens
+	bucket.lastRefill = state.LastRefill
+}
+
+func (bucket *TokenBucketTrivial) MarshalBinary() ([]byte, error) {
+	return bucket.state().MarshalBinary()
+}
+
+func (bucket *TokenBucketTrivial) UnmarshalBinary(data []byte) error {
+	state, err := decodeState(data, 1)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
+func (bucket *TokenBucketTrivial) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bucket.state())
+}
+
+func (bucket *TokenBucketTrivial) UnmarshalJSON(data []byte) error {
+	state, err := decodeStateJSON(data, 1)
+	if err != nil {
+		return err
+	}
+	bucket.restore(state)
+	return nil
+}
+
 var _ TokenBucketInterface = (*TokenBucketTrivial)(nil)
@@ -0,0 +1,240 @@
+// Client side pacing of outgoing HTTP requests per host which backs off when the server signals that it is overloaded
+
+package transport
+
+import (
+	"net/http"
+	"stepwell/tokenbucket"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// on every successful response the rate of a host grows by this share of the configured rate until it is back at it
+const recoveryStep = 0.05
+
+const (
+	DefaultHostTTL  = 10 * time.Minute
+	DefaultMaxHosts = 10_000
+	// how many hosts are looked at to find an eviction victim, like keyed.KeyedLimiter
+	evictionSamples = 16
+)
+
+type hostLimiter struct {
+	bucket tokenbucket.TokenBucketInterface
+	// current refill rate, lower than the configured one while the host is backing off
+	refillRate float64
+	// Store as Unix timestamp to be able to use atomic operations
+	blockedUntil int64
+	// Unix timestamp in nanoseconds of the last request, guarded by the lock of the Transport
+	lastSeen int64
+	sync.Mutex
+}
+
+// Transport wraps another http.RoundTripper. The buckets are used by all goroutines sending through the
+// transport, so bucketType has to be one of the thread safe types.
+type Transport struct {
+	next       http.RoundTripper
+	bucketType int
+	capacity   int64
+	refillRate float64
+	// the rate never drops below MinRefillRate, no matter how often the server answers with 429
+	MinRefillRate float64
+	// hosts which sent no request for HostTTL are forgotten, 0 keeps them until they are evicted
+	HostTTL time.Duration
+	// hard cap on tracked hosts, the least recently used hosts are evicted to stay below it. 0 means unlimited.
+	MaxHosts  int
+	hosts     map[string]*hostLimiter
+	nextSweep int64
+	sync.Mutex
+}
+
+func NewTransport(next http.RoundTripper, bucketType int, capacity int64, refillRate float64) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{
+		next:          next,
+		bucketType:    bucketType,
+		capacity:      capacity,
+		refillRate:    refillRate,
+		MinRefillRate: refillRate / 100,
+		HostTTL:       DefaultHostTTL,
+		MaxHosts:      DefaultMaxHosts,
+		hosts:         make(map[string]*hostLimiter),
+	}
+}
+
+func (transport *Transport) host(host string) *hostLimiter {
+	now := time.Now()
+	transport.Lock()
+	defer transport.Unlock()
+	if transport.HostTTL > 0 && now.UnixNano() >= transport.nextSweep {
+		transport.sweep(now)
+		transport.nextSweep = now.Add(transport.HostTTL).UnixNano()
+	}
+	limiter, ok := transport.hosts[host]
+	if !ok {
+		if transport.MaxHosts > 0 && len(transport.hosts) >= transport.MaxHosts {
+			transport.evict()
+		}
+		limiter = &hostLimiter{
+			bucket:     tokenbucket.NewTokenBucketByType(transport.bucketType, transport.capacity, transport.refillRate, now),
+			refillRate: transport.refillRate,
+		}
+		transport.hosts[host] = limiter
+	}
+	limiter.lastSeen = now.UnixNano()
+	return limiter
+}
+
+// sweep forgets the hosts which were idle for longer than HostTTL, the caller holds the lock.
+// A host which comes back starts again at the configured rate.
+func (transport *Transport) sweep(now time.Time) {
+	deadline := now.Add(-transport.HostTTL).UnixNano()
+	for host, limiter := range transport.hosts {
+		if limiter.lastSeen < deadline {
+			delete(transport.hosts, host)
+		}
+	}
+}
+
+// evict removes hosts until there is room for one more. Every victim is the least recently used host of a
+// small sample, map iteration starts at a random entry. The caller holds the lock.
+func (transport *Transport) evict() {
+	for len(transport.hosts) >= transport.MaxHosts {
+		victim := ""
+		var victimSeen int64
+		samples := 0
+		for host, limiter := range transport.hosts {
+			if victim == "" || limiter.lastSeen < victimSeen {
+				victim, victimSeen = host, limiter.lastSeen
+			}
+			if samples++; samples >= evictionSamples {
+				break
+			}
+		}
+		delete(transport.hosts, victim)
+	}
+}
+
+// NumHosts returns how many hosts the transport tracks
+func (transport *Transport) NumHosts() int {
+	transport.Lock()
+	defer transport.Unlock()
+	return len(transport.hosts)
+}
+
+// GetRefillRate returns the current rate of a host
+func (transport *Transport) GetRefillRate(host string) float64 {
+	limiter := transport.host(host)
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.refillRate
+}
+
+// wait blocks until the bucket of the host hands out a token or the request is canceled
+func (limiter *hostLimiter) wait(req *http.Request) error {
+	for {
+		now := time.Now()
+		delay := time.Duration(atomic.LoadInt64(&limiter.blockedUntil) - now.UnixNano())
+		if delay <= 0 {
+			if limiter.bucket.IsAllowed(1, now) {
+				return nil
+			}
+			limiter.Lock()
+			delay = time.Duration(float64(time.Second) / limiter.refillRate)
+			limiter.Unlock()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (transport *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limiter := transport.host(req.URL.Host)
+	if err := limiter.wait(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	transport.adapt(limiter, resp)
+	return resp, nil
+}
+
+// retryAfter reads Retry-After as seconds or HTTP date and falls back to RateLimit-Reset
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return date.Sub(now), true
+		}
+	}
+	if value := resp.Header.Get("RateLimit-Reset"); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// serverRate is the rate the RateLimit headers allow: the remaining requests spread over the time until the reset
+func serverRate(resp *http.Response) (float64, bool) {
+	remaining, err := strconv.ParseInt(resp.Header.Get("RateLimit-Remaining"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil || reset <= 0 {
+		return 0, false
+	}
+	return float64(remaining) / float64(reset), true
+}
+
+func (transport *Transport) adapt(limiter *hostLimiter, resp *http.Response) {
+	now := time.Now()
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	refillRate := limiter.refillRate
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := retryAfter(resp, now); ok && delay > 0 {
+			atomic.StoreInt64(&limiter.blockedUntil, now.Add(delay).UnixNano())
+		}
+		if rate, ok := serverRate(resp); ok && rate > 0 && rate < refillRate {
+			refillRate = rate
+		} else {
+			refillRate /= 2
+		}
+	} else if rate, ok := serverRate(resp); ok && rate < refillRate {
+		// the server tells us that we are going to run out, slow down before it says no
+		refillRate = rate
+	} else {
+		refillRate += transport.refillRate * recoveryStep
+	}
+
+	if refillRate > transport.refillRate {
+		refillRate = transport.refillRate
+	}
+	if refillRate < transport.MinRefillRate {
+		refillRate = transport.MinRefillRate
+	}
+	if refillRate != limiter.refillRate {
+		limiter.refillRate = refillRate
+		limiter.bucket.SetRefillRate(refillRate)
+	}
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
@@ -0,0 +1,254 @@
+// Limiter daemon on a Unix domain socket with fixed-size binary frames for decisions across processes in a few microseconds.
+//
+// Request (24 bytes, little endian): key id uint64 | amount int64 | port hint uint64
+// Response (16 bytes, little endian): allowed uint64 (0 or 1) | tokens left int64
+//
+// A client may write many requests with one write, the server answers all complete requests it
+// received with one read in a single write.
+
+package unixsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"stepwell/extensions"
+	"stepwell/keyed"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RequestSize  = 24
+	ResponseSize = 16
+	// NoPortHint lets the server pick the leaf of the connection
+	NoPortHint = ^uint64(0)
+	// requests answered with at most one read and one write
+	maxBatch = 256
+)
+
+type Request struct {
+	KeyID    uint64
+	Amount   int64
+	PortHint uint64
+}
+
+type Response struct {
+	Allowed    bool
+	TokensLeft int64
+}
+
+// defaults which keep the memory of the daemon bounded no matter which key ids clients send
+const (
+	DefaultMaxKeys = 100_000
+	DefaultTTL     = 10 * time.Minute
+)
+
+// every key id gets its own StepWell built from this template
+type Config struct {
+	NumCores   uint64
+	BucketType int
+	Capacity   int64
+	RefillRate float64
+	// pin the goroutine of every connection to a core picked by its leaf
+	PinThreads bool
+	// errors of a connection which cannot be returned to the caller, nil drops them
+	ErrorLog *log.Logger
+	// keys which were not used for TTL are dropped, 0 uses DefaultTTL
+	TTL time.Duration
+	// at most MaxKeys keys are tracked, the least recently used ones are evicted. 0 uses DefaultMaxKeys.
+	MaxKeys int
+}
+
+type Server struct {
+	config   Config
+	limiter  *keyed.KeyedLimiter
+	numConns uint64
+}
+
+// NewServer starts the worker which drops idle keys, Close stops it
+func NewServer(config Config) *Server {
+	if config.NumCores <= 0 {
+		config.NumCores = 1
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.MaxKeys <= 0 {
+		config.MaxKeys = DefaultMaxKeys
+	}
+	limiter := keyed.NewKeyedLimiter(keyed.Config{
+		BucketType: config.BucketType,
+		Capacity:   config.Capacity,
+		RefillRate: config.RefillRate,
+		NumCores:   config.NumCores,
+		IsHot:      func(key string) bool { return true },
+		TTL:        config.TTL,
+		MaxKeys:    config.MaxKeys,
+	})
+	limiter.StartWorker()
+	return &Server{config: config, limiter: limiter}
+}
+
+func (server *Server) Close() {
+	server.limiter.StopWorker()
+}
+
+// key is the key id as it arrived in the request frame, so looking up a known key does not allocate
+func (server *Server) decide(request Request, key []byte, port uint64, now time.Time) Response {
+	if request.PortHint < server.config.NumCores {
+		port = request.PortHint
+	}
+	limiter := server.limiter.GetBytes(key, now)
+	// a negative amount would put tokens into the buckets
+	if request.Amount < 0 {
+		return Response{Allowed: false, TokensLeft: limiter.GetTokensAt(port, now)}
+	}
+	allowed := limiter.IsAllowed(port, request.Amount, now)
+	return Response{Allowed: allowed, TokensLeft: limiter.GetTokensAt(port, now)}
+}
+
+// ListenAndServe removes a stale socket file left behind by an earlier run before it listens
+func (server *Server) ListenAndServe(path string) error {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return server.Serve(listener)
+}
+
+func (server *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		// every connection is served by one goroutine which maps to one leaf of the StepWells
+		port := (atomic.AddUint64(&server.numConns, 1) - 1) % server.config.NumCores
+		go server.handleConn(conn, port)
+	}
+}
+
+func (server *Server) handleConn(conn net.Conn, port uint64) {
+	defer conn.Close()
+	if server.config.PinThreads {
+		// there may be more leaves than cores
+		core := int(port % uint64(runtime.NumCPU()))
+		if err := extensions.PinToCore(core); err != nil && server.config.ErrorLog != nil {
+			server.config.ErrorLog.Printf("failed to pin connection to core %d: %v", core, err)
+		}
+	}
+
+	in := make([]byte, maxBatch*RequestSize)
+	out := make([]byte, maxBatch*ResponseSize)
+	buffered := 0
+	for {
+		n, err := conn.Read(in[buffered:])
+		if err != nil {
+			return
+		}
+		buffered += n
+
+		now := time.Now()
+		numRequests := buffered / RequestSize
+		for i := 0; i < numRequests; i++ {
+			frame := in[i*RequestSize:]
+			response := server.decide(Request{
+				KeyID:    binary.LittleEndian.Uint64(frame[0:]),
+				Amount:   int64(binary.LittleEndian.Uint64(frame[8:])),
+				PortHint: binary.LittleEndian.Uint64(frame[16:]),
+			}, frame[0:8], port, now)
+			putResponse(out[i*ResponseSize:], response)
+		}
+		if _, err := conn.Write(out[:numRequests*ResponseSize]); err != nil {
+			return
+		}
+
+		// keep the start of a request which did not arrive completely yet
+		buffered = copy(in, in[numRequests*RequestSize:buffered])
+	}
+}
+
+func putResponse(frame []byte, response Response) {
+	allowed := uint64(0)
+	if response.Allowed {
+		allowed = 1
+	}
+	binary.LittleEndian.PutUint64(frame[0:], allowed)
+	binary.LittleEndian.PutUint64(frame[8:], uint64(response.TokensLeft))
+}
+
+// Client is safe for concurrent use, but every call holds the connection until its answers arrived.
+// Processes with many threads should open one client per thread.
+type Client struct {
+	conn net.Conn
+	in   []byte
+	out  []byte
+	sync.Mutex
+}
+
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		in:   make([]byte, maxBatch*ResponseSize),
+		out:  make([]byte, maxBatch*RequestSize),
+	}, nil
+}
+
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+func (client *Client) IsAllowed(keyID uint64, amount int64, portHint uint64) (Response, error) {
+	responses := [1]Response{}
+	err := client.Batch([]Request{{KeyID: keyID, Amount: amount, PortHint: portHint}}, responses[:])
+	return responses[0], err
+}
+
+// Batch sends all requests with one write and fills responses in the same order
+func (client *Client) Batch(requests []Request, responses []Response) error {
+	if len(responses) < len(requests) {
+		return errors.New("not enough room for the responses")
+	}
+	client.Lock()
+	defer client.Unlock()
+
+	for start := 0; start < len(requests); start += maxBatch {
+		end := start + maxBatch
+		if end > len(requests) {
+			end = len(requests)
+		}
+		batch := requests[start:end]
+		for i, request := range batch {
+			frame := client.out[i*RequestSize:]
+			binary.LittleEndian.PutUint64(frame[0:], request.KeyID)
+			binary.LittleEndian.PutUint64(frame[8:], uint64(request.Amount))
+			binary.LittleEndian.PutUint64(frame[16:], request.PortHint)
+		}
+		if _, err := client.conn.Write(client.out[:len(batch)*RequestSize]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(client.conn, client.in[:len(batch)*ResponseSize]); err != nil {
+			return err
+		}
+		for i := range batch {
+			frame := client.in[i*ResponseSize:]
+			responses[start+i] = Response{
+				Allowed:    binary.LittleEndian.Uint64(frame[0:]) == 1,
+				TokensLeft: int64(binary.LittleEndian.Uint64(frame[8:])),
+			}
+		}
+	}
+	return nil
+}